@@ -7,11 +7,15 @@ import (
 	_ "github.com/aaronland/go-sqlite-modernc"
 	"github.com/aaronland/go-sqlite/v2"
 	"github.com/aaronland/go-sqlite/v2/tables"
+	"github.com/mattn/go-isatty"
 	"github.com/whosonfirst/go-whosonfirst-iterate/v2/emitter"
 	"github.com/whosonfirst/go-whosonfirst-sqlite-index/v4"
+	"github.com/whosonfirst/go-whosonfirst-sqlite-index/v4/config"
 	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -20,6 +24,81 @@ type Example struct {
 	Time int64 `json:"time"`
 }
 
+// TableModeFlags holds one or more {TABLE}={MODE} strings.
+type TableModeFlags map[string]string
+
+func (fl TableModeFlags) String() string {
+	return ""
+}
+
+func (fl TableModeFlags) Set(value string) error {
+
+	parts := strings.Split(value, "=")
+
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid table mode flag '%s'", value)
+	}
+
+	fl[parts[0]] = parts[1]
+	return nil
+}
+
+// TablePolicyFlags holds one or more {TABLE}={POLICY} or {TABLE}=disable-after:{COUNT} strings.
+type TablePolicyFlags map[string]*config.TablePolicy
+
+func (fl TablePolicyFlags) String() string {
+	return ""
+}
+
+func (fl TablePolicyFlags) Set(value string) error {
+
+	parts := strings.Split(value, "=")
+
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid table policy flag '%s'", value)
+	}
+
+	policy := &config.TablePolicy{
+		Policy: parts[1],
+	}
+
+	policy_parts := strings.Split(parts[1], ":")
+
+	if len(policy_parts) == 2 {
+
+		max, err := strconv.ParseInt(policy_parts[1], 10, 64)
+
+		if err != nil {
+			return fmt.Errorf("Invalid table policy flag '%s', %w", value, err)
+		}
+
+		policy.Policy = policy_parts[0]
+		policy.MaxFailures = max
+	}
+
+	fl[parts[0]] = policy
+	return nil
+}
+
+// TableQueryFlags holds one or more {TABLE}:{PATH}={REGEXP} strings.
+type TableQueryFlags map[string][]string
+
+func (fl TableQueryFlags) String() string {
+	return ""
+}
+
+func (fl TableQueryFlags) Set(value string) error {
+
+	parts := strings.SplitN(value, ":", 2)
+
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid table query flag '%s'", value)
+	}
+
+	fl[parts[0]] = append(fl[parts[0]], parts[1])
+	return nil
+}
+
 func main() {
 
 	valid_modes := strings.Join(emitter.Schemes(), ",")
@@ -30,40 +109,234 @@ func main() {
 	db_uri := flag.String("database-uri", "modernc://mem", "")
 
 	live_hard := flag.Bool("live-hard-die-fast", true, "Enable various performance-related pragmas at the expense of possible (unlikely) database corruption")
+	pragma_profile := flag.String("pragma-profile", "", fmt.Sprintf("The name of a set of pragmas to apply during indexing. If present it supersedes the -live-hard-die-fast flag. Valid profiles are: %s.", strings.Join(index.PragmaProfiles(), ",")))
+
+	table_modes := make(TableModeFlags)
+	flag.Var(table_modes, "table-mode", "One or more {TABLE}={MODE} strings used to prepare tables before indexing. Valid modes are: append,truncate,recreate.")
+
+	table_queries := make(TableQueryFlags)
+	flag.Var(table_queries, "table-query", "One or more {TABLE}:{PATH}={REGEXP} strings. If present records must match all the queries for a table in order to be indexed in that table.")
+
+	table_policies := make(TablePolicyFlags)
+	flag.Var(table_policies, "table-policy", "One or more {TABLE}={POLICY} strings used to handle failures to index records in a table. Valid policies are: required,best-effort,disable-after:{COUNT}.")
+
+	load_timeout := flag.Duration("load-timeout", 0, "The optional maximum amount of time to wait for an individual record to load.")
+	table_timeout := flag.Duration("table-timeout", 0, "The optional maximum amount of time to wait for an individual record to be indexed in a table. Timeouts are handled according to each table's policy.")
+	slow_record_threshold := flag.Duration("slow-record-threshold", 0, "If greater than zero, log and report records whose load time, or time to index in any table, exceeds this duration.")
+
+	finalize := flag.String("finalize", "", "An optional comma-separated list of finalization steps to perform, in order, after indexing. Valid steps are: create-indexes,analyze,optimize,vacuum,integrity-check. The create-indexes step drops the indexes of each table before indexing and creates them again when it is performed.")
+
+	swap_path := flag.String("swap-path", "", "The optional path of a published database file. If present the database defined by -database-uri is atomically copied to this path after a successful run, leaving any existing file untouched if the run fails.")
+	swap_integrity_check := flag.Bool("swap-integrity-check", false, "Run an integrity check against the database before it is copied to -swap-path")
+
+	record_runs := flag.Bool("record-runs", false, "Record metadata about each run in the _index_runs table")
+
+	log_format := flag.String("log-format", "", "If present, write structured log messages in this format. Valid formats are: text,json.")
+	log_level := flag.String("log-level", "", "The minimum level of structured log messages to write. Valid levels are: debug,info,warn,error. If present without -log-format messages are written as text.")
+
+	dry_run := flag.Bool("dry-run", false, "Load records and index them in a throwaway in-memory database, reporting statistics and errors, without touching the database defined by -database-uri.")
+
+	progress := flag.Bool("progress", false, "Count the records in each source before indexing and report progress (processed/total, records per second and ETA) during indexing.")
+
+	limit := flag.Int64("limit", 0, "If greater than zero, stop indexing after this many records.")
+	sample := flag.Float64("sample", 0, "If greater than zero, index only this fraction (0-1) of records, selected deterministically by a hash of each record's path relative to its source.")
+	seed := flag.Int64("seed", 0, "The seed used with -sample to select records. Different seeds select different samples.")
+
 	timings := flag.Bool("timings", false, "Display timings during and after indexing")
 
 	post_index := flag.Bool("post-index", false, "Enable post indexing callback function")
 
+	concurrent_sources := flag.Bool("concurrent-sources", false, "Process the sources defined by a job concurrently rather than in order")
+
+	config_path := flag.String("config", "", "The path to an optional JSON-encoded file describing one or more indexing jobs. Flags that are explicitly set will override the values in each job.")
+
 	flag.Parse()
 
 	ctx := context.Background()
 
-	db, err := sqlite.NewDatabase(ctx, *db_uri)
+	var jobs []*config.Job
 
-	if err != nil {
-		log.Fatalf("unable to create database (%s) because %s", *db_uri, err)
+	if *config_path != "" {
+
+		cfg, err := config.ReadConfigFromPath(ctx, *config_path)
+
+		if err != nil {
+			log.Fatalf("Failed to read config (%s) because %s", *config_path, err)
+		}
+
+		jobs = cfg.Jobs
+
+	} else {
+		jobs = []*config.Job{
+			new(config.Job),
+		}
 	}
 
-	defer db.Close(ctx)
+	is_set := make(map[string]bool)
+
+	flag.Visit(func(fl *flag.Flag) {
+		is_set[fl.Name] = true
+	})
+
+	uris := flag.Args()
+
+	for _, job := range jobs {
+
+		if is_set["emitter-uri"] || len(uris) > 0 || len(job.Sources) == 0 {
 
-	if *live_hard {
+			job.Sources = []*config.Source{
+				&config.Source{
+					IteratorURI: *emitter_uri,
+					URIs:        uris,
+				},
+			}
+		}
+
+		if is_set["database-uri"] || job.DatabaseURI == "" {
+			job.DatabaseURI = *db_uri
+		}
+
+		if is_set["live-hard-die-fast"] || job.LiveHardDieFast == nil {
+			job.LiveHardDieFast = live_hard
+		}
+
+		if is_set["pragma-profile"] {
+			job.PragmaProfile = *pragma_profile
+		}
+
+		if is_set["table-mode"] {
+
+			if job.TableModes == nil {
+				job.TableModes = make(map[string]string)
+			}
+
+			for name, mode := range table_modes {
+				job.TableModes[name] = mode
+			}
+		}
+
+		if is_set["table-query"] {
+			job.TableQueries = table_queries
+		}
+
+		if is_set["table-policy"] {
+			job.TablePolicies = table_policies
+		}
+
+		if is_set["load-timeout"] {
+			job.LoadTimeout = load_timeout.String()
+		}
+
+		if is_set["table-timeout"] {
+			job.TableTimeout = table_timeout.String()
+		}
+
+		if is_set["slow-record-threshold"] {
+			job.SlowRecordThreshold = slow_record_threshold.String()
+		}
+
+		if is_set["finalize"] {
+			job.Finalize = strings.Split(*finalize, ",")
+		}
+
+		if is_set["swap-path"] {
+			job.SwapPath = *swap_path
+		}
+
+		if is_set["swap-integrity-check"] {
+			job.SwapIntegrityCheck = *swap_integrity_check
+		}
+
+		if is_set["record-runs"] {
+			job.RecordRuns = *record_runs
+		}
+
+		if is_set["log-format"] {
+			job.LogFormat = *log_format
+		}
+
+		if is_set["log-level"] {
+			job.LogLevel = *log_level
+		}
+
+		if is_set["dry-run"] {
+			job.DryRun = *dry_run
+		}
+
+		if is_set["progress"] {
+			job.Progress = *progress
+		}
+
+		if is_set["limit"] {
+			job.Limit = *limit
+		}
+
+		if is_set["sample"] {
+			job.Sample = *sample
+		}
+
+		if is_set["seed"] {
+			job.Seed = *seed
+		}
+
+		if is_set["timings"] {
+			job.Timings = *timings
+		}
+
+		if is_set["post-index"] {
+			job.PostIndex = *post_index
+		}
+
+		if is_set["concurrent-sources"] {
+			job.ConcurrentSources = *concurrent_sources
+		}
+	}
 
-		err = sqlite.LiveHardDieFast(ctx, db)
+	for i, job := range jobs {
+
+		err := runJob(ctx, job)
 
 		if err != nil {
-			log.Fatalf("Unable to live hard and die fast so just dying fast instead, because %s", err)
+			log.Fatalf("Failed to run %s because: %s", job.Label(i), err)
 		}
 	}
 
-	to_index := make([]sqlite.Table, 0)
+	os.Exit(0)
+}
+
+func runJob(ctx context.Context, job *config.Job) error {
+
+	database_uri := job.DatabaseURI
 
-	ex, err := tables.NewExampleTableWithDatabase(ctx, db)
+	if job.DryRun {
+		database_uri = "modernc://mem"
+	}
+
+	db, err := sqlite.NewDatabase(ctx, database_uri)
 
 	if err != nil {
-		log.Fatalf("failed to create 'example' table because '%s'", err)
+		return fmt.Errorf("unable to create database (%s) because %w", database_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	profile := job.PragmaProfile
+
+	if profile == "" && *job.LiveHardDieFast {
+		profile = index.PRAGMA_PROFILE_BULK_LOAD
+	}
+
+	table_names := job.Tables
+
+	if len(table_names) == 0 {
+		table_names = []string{"example"}
 	}
 
-	to_index = append(to_index, ex)
+	to_index, err := newTables(ctx, db, table_names)
+
+	if err != nil {
+		return err
+	}
 
 	record_func := func(ctx context.Context, path string, fh io.ReadSeeker, args ...interface{}) (interface{}, error) {
 
@@ -77,12 +350,89 @@ func main() {
 	}
 
 	idx_opts := &index.SQLiteIndexerOptions{
-		DB:             db,
-		Tables:         to_index,
-		LoadRecordFunc: record_func,
+		DB:                 db,
+		Tables:             to_index,
+		LoadRecordFunc:     record_func,
+		PragmaProfile:      profile,
+		Finalize:           job.Finalize,
+		TableModes:         job.TableModes,
+		RecordRuns:         job.RecordRuns,
+		SwapPath:           job.SwapPath,
+		SwapIntegrityCheck: job.SwapIntegrityCheck,
+	}
+
+	// Targets are not written to during a dry run so their databases are not opened, nor are their tables created
+
+	targets := job.Targets
+
+	if job.DryRun {
+		targets = nil
+	}
+
+	for _, t := range targets {
+
+		target_names := t.Tables
+
+		if len(target_names) == 0 {
+			target_names = table_names
+		}
+
+		target := &index.Target{
+			Name:          t.Name,
+			LockBatchSize: t.LockBatchSize,
+		}
+
+		// Sharded targets open (and initialize the tables in) their own databases
+
+		if t.Sharding != nil {
+
+			target.Sharding = &index.Sharding{
+				Path:         t.Sharding.Path,
+				MaxSize:      t.Sharding.MaxSize,
+				SizeInterval: t.Sharding.SizeInterval,
+				ManifestPath: t.Sharding.ManifestPath,
+			}
+
+			if t.Sharding.ShardKey != "" {
+				target.Sharding.KeyFunc = index.NewPropertyShardKeyFunc(t.Sharding.ShardKey)
+			}
+
+		} else {
+
+			target_db, err := sqlite.NewDatabase(ctx, t.DatabaseURI)
+
+			if err != nil {
+				return fmt.Errorf("unable to create database (%s) for '%s' target because %w", t.DatabaseURI, t.Name, err)
+			}
+
+			defer target_db.Close(ctx)
+
+			target.DB = target_db
+		}
+
+		target_tables, err := newTables(ctx, target.DB, target_names)
+
+		if err != nil {
+			return fmt.Errorf("Failed to create tables for '%s' target, %w", t.Name, err)
+		}
+
+		target.Tables = target_tables
+
+		if len(t.Queries) > 0 {
+
+			predicate, err := index.NewQueryRoutingFunc(t.Queries, "")
+
+			if err != nil {
+				return fmt.Errorf("Failed to create predicate for '%s' target, %w", t.Name, err)
+			}
+
+			target.Predicate = predicate
+		}
+
+		idx_opts.Targets = append(idx_opts.Targets, target)
 	}
 
-	if *post_index {
+	if job.PostIndex {
 
 		post_func := func(ctx context.Context, db sqlite.Database, tables []sqlite.Table, record interface{}) error {
 			log.Printf("Post index func w/ %v", record)
@@ -92,19 +442,207 @@ func main() {
 		idx_opts.PostIndexFunc = post_func
 	}
 
+	if len(job.TableQueries) > 0 {
+
+		idx_opts.TableRoutes = make(map[string]index.SQLiteIndexerRoutingFunc)
+
+		for name, queries := range job.TableQueries {
+
+			route_func, err := index.NewQueryRoutingFunc(queries, "")
+
+			if err != nil {
+				return fmt.Errorf("Failed to create routing function for '%s' table, %w", name, err)
+			}
+
+			idx_opts.TableRoutes[name] = route_func
+		}
+	}
+
+	if job.LogFormat != "" || job.LogLevel != "" {
+
+		var level slog.Level
+
+		if job.LogLevel != "" {
+
+			err := level.UnmarshalText([]byte(job.LogLevel))
+
+			if err != nil {
+				return fmt.Errorf("Invalid log level, %w", err)
+			}
+		}
+
+		logger, err := index.NewStructuredLogger(os.Stderr, job.LogFormat, level)
+
+		if err != nil {
+			return fmt.Errorf("Failed to create logger, %w", err)
+		}
+
+		idx_opts.StructuredLogger = logger
+	}
+
+	if job.DryRun {
+		idx_opts.DB = nil
+		idx_opts.DryRun = true
+		idx_opts.DryRunDatabase = db
+	}
+
+	idx_opts.Limit = job.Limit
+	idx_opts.SampleRate = job.Sample
+	idx_opts.SampleSeed = job.Seed
+
+	if job.Progress {
+		idx_opts.PreScan = true
+		idx_opts.ProgressFunc = progressFunc()
+	}
+
+	idx_opts.LoadTimeout, err = parseDuration(job.LoadTimeout)
+
+	if err != nil {
+		return fmt.Errorf("Invalid load timeout, %w", err)
+	}
+
+	idx_opts.TableTimeout, err = parseDuration(job.TableTimeout)
+
+	if err != nil {
+		return fmt.Errorf("Invalid table timeout, %w", err)
+	}
+
+	idx_opts.SlowRecordThreshold, err = parseDuration(job.SlowRecordThreshold)
+
+	if err != nil {
+		return fmt.Errorf("Invalid slow record threshold, %w", err)
+	}
+
+	if len(job.TablePolicies) > 0 {
+
+		idx_opts.TablePolicies = make(map[string]*index.TablePolicy)
+
+		for name, p := range job.TablePolicies {
+
+			idx_opts.TablePolicies[name] = &index.TablePolicy{
+				Policy:      p.Policy,
+				MaxFailures: p.MaxFailures,
+			}
+		}
+	}
+
 	idx, err := index.NewSQLiteIndexer(idx_opts)
 
 	if err != nil {
-		log.Fatalf("failed to create sqlite indexer because %s", err)
+		return fmt.Errorf("failed to create sqlite indexer because %w", err)
 	}
 
-	idx.Timings = *timings
+	idx.Timings = job.Timings
+	idx.ConcurrentSources = job.ConcurrentSources
 
-	err = idx.IndexPaths(ctx, *emitter_uri, flag.Args())
+	sources := make([]index.Source, len(job.Sources))
+
+	for i, src := range job.Sources {
+
+		sources[i] = index.Source{
+			IteratorURI: src.IteratorURI,
+			URIs:        src.URIs,
+		}
+	}
+
+	err = idx.IndexSources(ctx, sources)
 
 	if err != nil {
-		log.Fatalf("Failed to index paths in %s mode because: %s", *emitter_uri, err)
+		return fmt.Errorf("Failed to index sources because: %w", err)
 	}
 
-	os.Exit(0)
+	if job.DryRun {
+
+		stats := idx.Stats()
+		log.Printf("Dry run: %d seen, %d indexed, %d skipped, %d failed", stats.Seen, stats.Indexed, stats.Skipped, stats.Failed)
+
+		for _, err := range idx.Errors() {
+			log.Println(err)
+		}
+	}
+
+	for name, stats := range idx.TargetStats() {
+		log.Printf("Target %s: %d indexed, %d skipped, %d failed", name, stats.Indexed, stats.Skipped, stats.Failed)
+	}
+
+	return nil
+}
+
+// newTables returns the list of `sqlite.Table` instances, created using 'db', for 'names'. If 'db' is nil the tables
+// are created without being initialized.
+func newTables(ctx context.Context, db sqlite.Database, names []string) ([]sqlite.Table, error) {
+
+	to_index := make([]sqlite.Table, 0)
+
+	for _, name := range names {
+
+		switch name {
+		case "example":
+
+			var ex sqlite.Table
+			var err error
+
+			if db != nil {
+				ex, err = tables.NewExampleTableWithDatabase(ctx, db)
+			} else {
+				ex, err = tables.NewExampleTable(ctx)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to create 'example' table because '%w'", err)
+			}
+
+			to_index = append(to_index, ex)
+
+		default:
+			return nil, fmt.Errorf("Unsupported table '%s'", name)
+		}
+	}
+
+	return to_index, nil
+}
+
+// parseDuration parses 's' as a `time.Duration`, returning zero if 's' is empty.
+func parseDuration(s string) (time.Duration, error) {
+
+	if s == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// progressFunc returns an `index.ProgressFunc` that draws a progress bar if STDERR is a terminal
+// and otherwise logs progress messages.
+func progressFunc() index.ProgressFunc {
+
+	interactive := isatty.IsTerminal(os.Stderr.Fd())
+
+	return func(ctx context.Context, p *index.Progress) {
+
+		if !interactive {
+			log.Printf("Progress %s", p)
+			return
+		}
+
+		bar := ""
+
+		if p.Total > 0 {
+
+			width := 30
+			filled := int(float64(width) * float64(p.Processed) / float64(p.Total))
+
+			if filled > width {
+				filled = width
+			}
+
+			bar = fmt.Sprintf("[%s%s] ", strings.Repeat("=", filled), strings.Repeat(" ", width-filled))
+		}
+
+		fmt.Fprintf(os.Stderr, "\r\033[K%s%s", bar, p)
+
+		if p.Done {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
 }
@@ -0,0 +1,266 @@
+// package config provides methods for defining one or more indexing jobs in a JSON-encoded configuration file.
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Config is a struct describing one or more indexing jobs.
+type Config struct {
+	// Jobs is the list of indexing jobs to perform, in order.
+	Jobs []*Job `json:"jobs"`
+}
+
+// Source is a struct describing a `whosonfirst/go-whosonfirst-iterate/v2` iterator URI and the URIs it should process.
+type Source struct {
+	// IteratorURI is a valid `whosonfirst/go-whosonfirst-iterate/v2` URI.
+	IteratorURI string `json:"iterator_uri"`
+	// URIs is the list of URIs to be processed by the iterator defined by `IteratorURI`.
+	URIs []string `json:"uris"`
+}
+
+// TablePolicy is a struct describing how failures to index records in a table should be handled.
+type TablePolicy struct {
+	// Policy is the name of the policy: required, best-effort or disable-after.
+	Policy string `json:"policy"`
+	// MaxFailures is the number of failures after which a table is disabled when `Policy` is "disable-after".
+	MaxFailures int64 `json:"max_failures,omitempty"`
+}
+
+// Sharding is a struct describing how the records for a target are divided among multiple database files.
+type Sharding struct {
+	// Path is the path that shard filenames are derived from, for example "/usr/local/data/foo.db".
+	Path string `json:"path"`
+	// ShardKey is an optional `tidwall/gjson` path (for example "properties.wof:country") whose value is used to route each record to a shard.
+	ShardKey string `json:"shard_key,omitempty"`
+	// MaxSize is the optional size, in bytes, after which a new shard is started.
+	MaxSize int64 `json:"max_size,omitempty"`
+	// SizeInterval is the optional number of records written to a shard between checks of its size.
+	SizeInterval int `json:"size_interval,omitempty"`
+	// ManifestPath is the optional path of the manifest describing the shards written during each run.
+	ManifestPath string `json:"manifest_path,omitempty"`
+}
+
+// Target is a struct describing an additional database (and tables) that the records for a job are indexed in.
+type Target struct {
+	// Name is the unique name of the target.
+	Name string `json:"name"`
+	// DatabaseURI is a valid `aaronland/go-sqlite/v2` database URI. It is ignored if `Sharding` is present.
+	DatabaseURI string `json:"database_uri,omitempty"`
+	// Sharding is an optional `Sharding` definition used to divide records among multiple database files instead of `DatabaseURI`.
+	Sharding *Sharding `json:"sharding,omitempty"`
+	// Tables is the list of (named) tables that records will be indexed in.
+	Tables []string `json:"tables,omitempty"`
+	// Queries is an optional list of `aaronland/go-json-query` {PATH}={REGEXP} strings that a record must match (all of them)
+	// in order to be indexed in the target.
+	Queries []string `json:"queries,omitempty"`
+	// LockBatchSize is the optional number of records to write to the target while acquiring its lock once. Records are not written in a single transaction.
+	LockBatchSize int `json:"lock_batch_size,omitempty"`
+}
+
+// Job is a struct describing a single indexing job: the sources to read records from and the database (and tables) to index them in.
+type Job struct {
+	// Name is an optional label for the job used in logging.
+	Name string `json:"name,omitempty"`
+	// Sources is the list of `Source` instances to read records from.
+	Sources []*Source `json:"sources"`
+	// ConcurrentSources is a boolean flag indicating whether sources should be processed concurrently rather than in order.
+	ConcurrentSources bool `json:"concurrent_sources,omitempty"`
+	// DatabaseURI is a valid `aaronland/go-sqlite/v2` database URI.
+	DatabaseURI string `json:"database_uri"`
+	// Tables is the list of (named) tables that records will be indexed in.
+	Tables []string `json:"tables,omitempty"`
+	// Targets is an optional list of additional databases that records will be indexed in during the same pass.
+	Targets []*Target `json:"targets,omitempty"`
+	// TableModes is an optional map of table names and the mode (append, truncate, recreate) used to prepare that table before indexing.
+	TableModes map[string]string `json:"table_modes,omitempty"`
+	// TableQueries is an optional map of table names and one or more `aaronland/go-json-query` {PATH}={REGEXP} strings
+	// that a record must match (all of them) in order to be indexed in that table.
+	TableQueries map[string][]string `json:"table_queries,omitempty"`
+	// TablePolicies is an optional map of table names and the policy used to handle failures to index records in that table.
+	TablePolicies map[string]*TablePolicy `json:"table_policies,omitempty"`
+	// LoadTimeout is an optional duration (for example "30s") after which loading an individual record fails.
+	LoadTimeout string `json:"load_timeout,omitempty"`
+	// TableTimeout is an optional duration (for example "30s") after which indexing an individual record in a table fails.
+	TableTimeout string `json:"table_timeout,omitempty"`
+	// SlowRecordThreshold is an optional duration (for example "5s") after which records whose load time, or time to index in any table, exceeds it are logged.
+	SlowRecordThreshold string `json:"slow_record_threshold,omitempty"`
+	// LiveHardDieFast is an optional boolean flag signaling whether to enable various performance-related pragmas.
+	LiveHardDieFast *bool `json:"live_hard_die_fast,omitempty"`
+	// PragmaProfile is the optional name of a set of pragmas to apply during indexing. If present it supersedes `LiveHardDieFast`.
+	PragmaProfile string `json:"pragma_profile,omitempty"`
+	// Finalize is an optional list of finalization steps to perform, in order, after indexing.
+	Finalize []string `json:"finalize,omitempty"`
+	// SwapPath is the optional path of a published database file that the database will be atomically copied to after a successful run.
+	SwapPath string `json:"swap_path,omitempty"`
+	// SwapIntegrityCheck is a boolean flag indicating whether an integrity check should be run before the database is copied to `SwapPath`.
+	SwapIntegrityCheck bool `json:"swap_integrity_check,omitempty"`
+	// RecordRuns is a boolean flag indicating whether metadata about the run should be written to the `_index_runs` table.
+	RecordRuns bool `json:"record_runs,omitempty"`
+	// LogFormat is the optional format (text or json) used to write structured log messages.
+	LogFormat string `json:"log_format,omitempty"`
+	// LogLevel is the optional minimum level (debug, info, warn or error) of structured log messages to write.
+	LogLevel string `json:"log_level,omitempty"`
+	// DryRun is a boolean flag indicating whether records should be loaded, and indexed in a throwaway in-memory database, without touching `DatabaseURI`.
+	DryRun bool `json:"dry_run,omitempty"`
+	// Progress is a boolean flag indicating whether sources should be pre-scanned and progress reported during indexing.
+	Progress bool `json:"progress,omitempty"`
+	// Limit is the optional maximum number of records to index.
+	Limit int64 `json:"limit,omitempty"`
+	// Sample is the optional fraction (0-1) of records to index, selected deterministically by a hash of each record's path relative to its source.
+	Sample float64 `json:"sample,omitempty"`
+	// Seed is the seed used with `Sample` to select records.
+	Seed int64 `json:"seed,omitempty"`
+	// Timings is a boolean flag indicating whether timings should be displayed during indexing.
+	Timings bool `json:"timings,omitempty"`
+	// PostIndex is a boolean flag indicating whether a post indexing callback function should be enabled.
+	PostIndex bool `json:"post_index,omitempty"`
+}
+
+// ReadConfigFromPath returns a new `Config` instance derived from the JSON-encoded file at 'path'.
+func ReadConfigFromPath(ctx context.Context, path string) (*Config, error) {
+
+	r, err := os.Open(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %s, %w", path, err)
+	}
+
+	defer r.Close()
+
+	return ReadConfig(ctx, r)
+}
+
+// ReadConfig returns a new `Config` instance derived from the JSON-encoded body of 'r'. Environment variables
+// (for example `${WOF_DATA}/whosonfirst-data-admin-us`) in string values, other than queries and map keys, are
+// interpolated after the body has been decoded. Jobs with empty (null) sources, targets or table policies are rejected.
+func ReadConfig(ctx context.Context, r io.Reader) (*Config, error) {
+
+	var cfg *Config
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(&cfg)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode config, %w", err)
+	}
+
+	if cfg == nil || len(cfg.Jobs) == 0 {
+		return nil, fmt.Errorf("Config does not define any jobs")
+	}
+
+	for i, job := range cfg.Jobs {
+
+		if job == nil {
+			return nil, fmt.Errorf("Job at offset %d is empty", i)
+		}
+
+		err := job.validate()
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s, %w", job.Label(i), err)
+		}
+
+		job.expand()
+	}
+
+	return cfg, nil
+}
+
+// Label returns the name of the job or, if empty, a label derived from 'offset'.
+func (job *Job) Label(offset int) string {
+
+	if job.Name != "" {
+		return job.Name
+	}
+
+	return fmt.Sprintf("job #%d", offset+1)
+}
+
+// validate returns an error if any of the sources, targets or table policies in 'job' are empty.
+func (job *Job) validate() error {
+
+	for i, src := range job.Sources {
+
+		if src == nil {
+			return fmt.Errorf("Source at offset %d is empty", i)
+		}
+	}
+
+	for i, t := range job.Targets {
+
+		if t == nil {
+			return fmt.Errorf("Target at offset %d is empty", i)
+		}
+	}
+
+	for name, p := range job.TablePolicies {
+
+		if p == nil {
+			return fmt.Errorf("Policy for '%s' table is empty", name)
+		}
+	}
+
+	return nil
+}
+
+// expand interpolates environment variables in the string values of 'job' except for queries, since they are regular
+// expressions which may contain "$" characters, and map keys (table names).
+func (job *Job) expand() {
+
+	job.Name = os.ExpandEnv(job.Name)
+	job.DatabaseURI = os.ExpandEnv(job.DatabaseURI)
+	job.SwapPath = os.ExpandEnv(job.SwapPath)
+	job.LoadTimeout = os.ExpandEnv(job.LoadTimeout)
+	job.TableTimeout = os.ExpandEnv(job.TableTimeout)
+	job.SlowRecordThreshold = os.ExpandEnv(job.SlowRecordThreshold)
+	job.PragmaProfile = os.ExpandEnv(job.PragmaProfile)
+	job.LogFormat = os.ExpandEnv(job.LogFormat)
+	job.LogLevel = os.ExpandEnv(job.LogLevel)
+
+	expandAll(job.Tables)
+	expandAll(job.Finalize)
+
+	for name, mode := range job.TableModes {
+		job.TableModes[name] = os.ExpandEnv(mode)
+	}
+
+	for _, p := range job.TablePolicies {
+		p.Policy = os.ExpandEnv(p.Policy)
+	}
+
+	for _, src := range job.Sources {
+
+		src.IteratorURI = os.ExpandEnv(src.IteratorURI)
+
+		expandAll(src.URIs)
+	}
+
+	for _, t := range job.Targets {
+
+		t.Name = os.ExpandEnv(t.Name)
+		t.DatabaseURI = os.ExpandEnv(t.DatabaseURI)
+
+		expandAll(t.Tables)
+
+		if t.Sharding != nil {
+			t.Sharding.Path = os.ExpandEnv(t.Sharding.Path)
+			t.Sharding.ShardKey = os.ExpandEnv(t.Sharding.ShardKey)
+			t.Sharding.ManifestPath = os.ExpandEnv(t.Sharding.ManifestPath)
+		}
+	}
+}
+
+// expandAll interpolates environment variables in each of 'values', in place.
+func expandAll(values []string) {
+
+	for i, v := range values {
+		values[i] = os.ExpandEnv(v)
+	}
+}
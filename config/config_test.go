@@ -0,0 +1,138 @@
+package config
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+
+	ctx := context.Background()
+
+	os.Setenv("WOF_TEST_DATA", "/usr/local/data")
+
+	body := `{
+	"jobs": [
+		{
+			"name": "admin",
+			"sources": [
+				{ "iterator_uri": "repo://", "uris": [ "${WOF_TEST_DATA}/whosonfirst-data-admin-ca" ] }
+			],
+			"database_uri": "modernc://cwd/admin.db",
+			"tables": [ "example" ],
+			"live_hard_die_fast": false
+		}
+	]
+}`
+
+	cfg, err := ReadConfig(ctx, strings.NewReader(body))
+
+	if err != nil {
+		t.Fatalf("Failed to read config, %v", err)
+	}
+
+	if len(cfg.Jobs) != 1 {
+		t.Fatalf("Unexpected job count: %d", len(cfg.Jobs))
+	}
+
+	job := cfg.Jobs[0]
+
+	if job.Sources[0].URIs[0] != "/usr/local/data/whosonfirst-data-admin-ca" {
+		t.Fatalf("Environment variable not interpolated: %s", job.Sources[0].URIs[0])
+	}
+
+	if job.LiveHardDieFast == nil || *job.LiveHardDieFast {
+		t.Fatalf("Expected live_hard_die_fast to be explicitly false")
+	}
+
+	_, err = ReadConfig(ctx, strings.NewReader(`{ "jobs": [] }`))
+
+	if err == nil {
+		t.Fatalf("Expected config with no jobs to fail")
+	}
+
+	_, err = ReadConfig(ctx, strings.NewReader(`{ "jobs": [ { "database": "modernc://mem" } ] }`))
+
+	if err == nil {
+		t.Fatalf("Expected config with unknown fields to fail")
+	}
+}
+
+func TestExpandTargets(t *testing.T) {
+
+	ctx := context.Background()
+
+	os.Setenv("WOF_TEST_DATA", "/usr/local/data")
+
+	body := `{
+	"jobs": [
+		{
+			"sources": [
+				{ "iterator_uri": "repo://", "uris": [ "${WOF_TEST_DATA}/whosonfirst-data-admin-ca" ] }
+			],
+			"database_uri": "modernc://cwd/admin.db",
+			"targets": [
+				{ "name": "all", "database_uri": "modernc://${WOF_TEST_DATA}/all.db" },
+				{ "name": "countries", "sharding": { "path": "${WOF_TEST_DATA}/countries.db", "manifest_path": "${WOF_TEST_DATA}/manifest.json" } }
+			]
+		}
+	]
+}`
+
+	cfg, err := ReadConfig(ctx, strings.NewReader(body))
+
+	if err != nil {
+		t.Fatalf("Failed to read config, %v", err)
+	}
+
+	targets := cfg.Jobs[0].Targets
+
+	if targets[0].DatabaseURI != "modernc:///usr/local/data/all.db" {
+		t.Fatalf("Environment variable not interpolated: %s", targets[0].DatabaseURI)
+	}
+
+	sharding := targets[1].Sharding
+
+	if sharding.Path != "/usr/local/data/countries.db" {
+		t.Fatalf("Environment variable not interpolated: %s", sharding.Path)
+	}
+
+	if sharding.ManifestPath != "/usr/local/data/manifest.json" {
+		t.Fatalf("Environment variable not interpolated: %s", sharding.ManifestPath)
+	}
+}
+
+func TestReadConfigEmptyEntries(t *testing.T) {
+
+	ctx := context.Background()
+
+	jobs := []string{
+		`{ "jobs": [ { "sources": [ null ], "database_uri": "modernc://mem" } ] }`,
+		`{ "jobs": [ { "sources": [], "database_uri": "modernc://mem", "targets": [ null ] } ] }`,
+		`{ "jobs": [ { "sources": [], "database_uri": "modernc://mem", "table_policies": { "example": null } } ] }`,
+	}
+
+	for _, body := range jobs {
+
+		_, err := ReadConfig(ctx, strings.NewReader(body))
+
+		if err == nil {
+			t.Fatalf("Expected config with empty entries to fail, %s", body)
+		}
+	}
+
+	os.Setenv("WOF_TEST_TIMEOUT", "30s")
+	os.Setenv("WOF_TEST_PROFILE", "safe")
+
+	cfg, err := ReadConfig(ctx, strings.NewReader(`{ "jobs": [ { "sources": [], "database_uri": "modernc://mem", "load_timeout": "${WOF_TEST_TIMEOUT}", "pragma_profile": "${WOF_TEST_PROFILE}" } ] }`))
+
+	if err != nil {
+		t.Fatalf("Failed to read config, %v", err)
+	}
+
+	if cfg.Jobs[0].LoadTimeout != "30s" || cfg.Jobs[0].PragmaProfile != "safe" {
+		t.Fatalf("Environment variables not interpolated: %s %s", cfg.Jobs[0].LoadTimeout, cfg.Jobs[0].PragmaProfile)
+	}
+}
@@ -0,0 +1,84 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// recordErrors is a struct for collecting the errors for individual records encountered during a dry run.
+type recordErrors struct {
+	mu     *sync.Mutex
+	errors []error
+}
+
+// newRecordErrors returns a new `recordErrors` instance.
+func newRecordErrors() *recordErrors {
+
+	e := &recordErrors{
+		mu:     new(sync.Mutex),
+		errors: make([]error, 0),
+	}
+
+	return e
+}
+
+// Add appends 'err' to the list of errors.
+func (e *recordErrors) Add(err error) {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.errors = append(e.errors, err)
+}
+
+// Errors returns a copy of the list of errors.
+func (e *recordErrors) Errors() []error {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	errors := make([]error, len(e.errors))
+	copy(errors, e.errors)
+
+	return errors
+}
+
+// dryRun processes each of the sources in 'run' without touching the indexer's database. If a dry run database has
+// been defined the indexer's tables are initialized in, and records are indexed in, that database instead.
+func (idx *SQLiteIndexer) dryRun(ctx context.Context, run *indexRun) error {
+
+	run.errors = newRecordErrors()
+	defer idx.reportErrors(run)
+
+	if idx.dry_run_db != nil {
+
+		for _, t := range idx.tables {
+
+			err := t.InitializeTable(ctx, idx.dry_run_db)
+
+			if err != nil {
+				return fmt.Errorf("Failed to initialize '%s' table in dry run database, %w", t.Name(), err)
+			}
+		}
+	}
+
+	err := idx.processSources(ctx, run)
+
+	if err != nil {
+		return err
+	}
+
+	run.logger.Info("Completed dry run", "failed", len(run.errors.Errors()))
+	return nil
+}
+
+// reportErrors stores the errors for individual records encountered during 'run' so they can be retrieved by the `Errors` method.
+func (idx *SQLiteIndexer) reportErrors(run *indexRun) {
+
+	errors := run.errors.Errors()
+
+	idx.mu.Lock()
+	idx.record_errors = errors
+	idx.mu.Unlock()
+}
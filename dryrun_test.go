@@ -0,0 +1,63 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+
+	f := newTestFixture(t, "dry.db")
+
+	db := f.openDatabase(t, "target.db")
+
+	record_func := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+
+		if strings.HasSuffix(path, "_test.go") {
+			return nil, fmt.Errorf("Invalid record")
+		}
+
+		return exampleRecord(ctx, path, r, args...)
+	}
+
+	idx := f.indexer(t, &SQLiteIndexerOptions{
+		DB:             db,
+		LoadRecordFunc: record_func,
+		RecordRuns:     true,
+		Finalize:       []string{FINALIZE_VACUUM},
+		DryRun:         true,
+		DryRunDatabase: f.db,
+	})
+
+	err := idx.IndexURIs(f.ctx, "directory://", f.path("cmd"), f.path("config"))
+
+	if err != nil {
+		t.Fatalf("Expected dry run not to stop for record errors, %v", err)
+	}
+
+	stats := idx.Stats()
+
+	if stats.Seen != 3 || stats.Indexed != 2 || stats.Failed != 1 {
+		t.Fatalf("Unexpected stats %v", stats)
+	}
+
+	errs := idx.Errors()
+
+	var load_err *LoadError
+
+	if len(errs) != 1 || !errors.As(errs[0], &load_err) {
+		t.Fatalf("Unexpected errors %v", errs)
+	}
+
+	if f.count(t, db, "SELECT COUNT(*) FROM sqlite_master") != 0 {
+		t.Fatalf("Expected dry run not to touch target database")
+	}
+
+	if f.count(t, f.db, "SELECT COUNT(*) FROM example") != 2 {
+		t.Fatalf("Expected records to be indexed in dry run database")
+	}
+}
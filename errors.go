@@ -0,0 +1,133 @@
+package index
+
+import (
+	"fmt"
+)
+
+// LoadError is an error describing a record that could not be loaded, or whose key or last modified time could not be
+// derived. It usually indicates a problem with the source data rather than the database.
+type LoadError struct {
+	// Path is the path of the record, as reported by its source.
+	Path string
+	// Key is the key of the record. It is empty if the record could not be loaded or no key could be derived.
+	Key string
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns a description of the error.
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("Failed to load %s, %v", describeRecord(e.Key, e.Path), e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// TableIndexError is an error describing a record that could not be indexed in a table.
+type TableIndexError struct {
+	// Path is the path of the record, as reported by its source.
+	Path string
+	// Key is the key of the record. It may be empty if no key could be derived.
+	Key string
+	// Table is the name of the table the record could not be indexed in.
+	Table string
+	// Err is the underlying error returned by (or recovered from) the table's `IndexRecord` method.
+	Err error
+}
+
+// Error returns a description of the error.
+func (e *TableIndexError) Error() string {
+	return fmt.Sprintf("Failed to index %s in '%s' table, %v", describeRecord(e.Key, e.Path), e.Table, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *TableIndexError) Unwrap() error {
+	return e.Err
+}
+
+// PostIndexError is an error describing a failure of the indexer's post index function.
+type PostIndexError struct {
+	// Path is the path of the record, as reported by its source.
+	Path string
+	// Key is the key of the record. It may be empty if no key could be derived.
+	Key string
+	// Err is the underlying error returned by (or recovered from) the post index function.
+	Err error
+}
+
+// Error returns a description of the error.
+func (e *PostIndexError) Error() string {
+	return fmt.Sprintf("Post index function failed for %s, %v", describeRecord(e.Key, e.Path), e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *PostIndexError) Unwrap() error {
+	return e.Err
+}
+
+// DatabaseError is an error describing a failure to prepare, update or maintain the database itself, rather than to index
+// an individual record in a table. For example: failing to migrate a table's schema, apply pragmas, record provenance or
+// finalize the database.
+type DatabaseError struct {
+	// Op is a short description of the operation that failed, for example "migrate tables".
+	Op string
+	// Table is the name of the table the operation was performed on. It is empty if the operation was not specific to a table.
+	Table string
+	// Path is the path of the record the operation was performed for. It is empty if the operation was not specific to a record.
+	Path string
+	// Key is the key of the record the operation was performed for. It is empty if the operation was not specific to a record.
+	Key string
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns a description of the error.
+func (e *DatabaseError) Error() string {
+
+	switch {
+	case e.Path != "":
+		return fmt.Sprintf("Failed to %s for %s, %v", e.Op, describeRecord(e.Key, e.Path), e.Err)
+	case e.Table != "":
+		return fmt.Sprintf("Failed to %s for '%s' table, %v", e.Op, e.Table, e.Err)
+	default:
+		return fmt.Sprintf("Failed to %s, %v", e.Op, e.Err)
+	}
+}
+
+// Unwrap returns the underlying error.
+func (e *DatabaseError) Unwrap() error {
+	return e.Err
+}
+
+// TargetError is an error describing a failure to write records to a `Target`. Since records are written to targets
+// after they have been indexed in the indexer's database, records that could not be written to a target are counted
+// as failures in that target's statistics rather than the run's.
+type TargetError struct {
+	// Target is the name of the target.
+	Target string
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns a description of the error.
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("Failed to write to '%s' target, %v", e.Target, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *TargetError) Unwrap() error {
+	return e.Err
+}
+
+// describeRecord returns a short human-readable description of the record with 'key' and 'path' for use in errors
+// and log messages.
+func describeRecord(key string, path string) string {
+
+	if key == "" {
+		return fmt.Sprintf("feature (%s)", path)
+	}
+
+	return fmt.Sprintf("feature %s (%s)", key, path)
+}
@@ -0,0 +1,73 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"io"
+	"testing"
+)
+
+func TestTypedErrors(t *testing.T) {
+
+	f := newTestFixture(t, "errors.db")
+
+	build := func(opts *SQLiteIndexerOptions) error {
+
+		if opts.Tables == nil {
+			opts.Tables = []sqlite.Table{&BusyTable{}}
+		}
+
+		idx := f.indexer(t, opts)
+		return idx.IndexURIs(f.ctx, "directory://", f.path("cmd"))
+	}
+
+	err := build(&SQLiteIndexerOptions{
+		LoadRecordFunc: func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+			return nil, fmt.Errorf("Invalid JSON")
+		},
+	})
+
+	var load_err *LoadError
+
+	if !errors.As(err, &load_err) || load_err.Path == "" {
+		t.Fatalf("Expected LoadError, got %v", err)
+	}
+
+	err = build(&SQLiteIndexerOptions{
+		Tables: []sqlite.Table{&FailingTable{}},
+	})
+
+	var table_err *TableIndexError
+
+	if !errors.As(err, &table_err) || table_err.Table != "names" || table_err.Path == "" {
+		t.Fatalf("Expected TableIndexError, got %v", err)
+	}
+
+	err = build(&SQLiteIndexerOptions{
+		PostIndexFunc: func(ctx context.Context, db sqlite.Database, tables []sqlite.Table, record interface{}) error {
+			return fmt.Errorf("Failed to notify")
+		},
+	})
+
+	var post_err *PostIndexError
+
+	if !errors.As(err, &post_err) || post_err.Path == "" {
+		t.Fatalf("Expected PostIndexError, got %v", err)
+	}
+
+	err = build(&SQLiteIndexerOptions{
+		TableModes: map[string]string{"names": TABLE_MODE_TRUNCATE},
+	})
+
+	var db_err *DatabaseError
+
+	if !errors.As(err, &db_err) || db_err.Op != "prepare tables" {
+		t.Fatalf("Expected DatabaseError, got %v", err)
+	}
+
+	if errors.As(err, &table_err) {
+		t.Fatalf("Did not expect DatabaseError to be a TableIndexError")
+	}
+}
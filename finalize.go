@@ -0,0 +1,331 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"strings"
+	"time"
+)
+
+// FINALIZE_CREATE_INDEXES is a flag to signal that the (explicitly created) indexes of the indexer's tables should be
+// dropped before indexing and created again, using the same statements, when this step is performed. If the run fails
+// before then the indexes are created again before the run returns.
+const FINALIZE_CREATE_INDEXES string = "create-indexes"
+
+// FINALIZE_ANALYZE is a flag to signal that `ANALYZE` should be run after indexing.
+const FINALIZE_ANALYZE string = "analyze"
+
+// FINALIZE_OPTIMIZE is a flag to signal that `PRAGMA optimize` should be run after indexing.
+const FINALIZE_OPTIMIZE string = "optimize"
+
+// FINALIZE_VACUUM is a flag to signal that `VACUUM` should be run after indexing.
+const FINALIZE_VACUUM string = "vacuum"
+
+// FINALIZE_INTEGRITY_CHECK is a flag to signal that `PRAGMA integrity_check` should be run after indexing. Any
+// problems that are reported will cause the run to fail.
+const FINALIZE_INTEGRITY_CHECK string = "integrity-check"
+
+// FinalizableTable is an optional interface for `aaronland/go-sqlite.Table` implementations that need to do work
+// once all the records in a run have been indexed. For example, creating secondary indexes after the data has been
+// loaded is considerably faster than maintaining them during a bulk load.
+type FinalizableTable interface {
+	sqlite.Table
+	// Finalize is invoked once, after all the records in a run have been indexed.
+	Finalize(context.Context, sqlite.Database) error
+}
+
+// FinalizeTiming is a struct describing how long an individual finalization step took.
+type FinalizeTiming struct {
+	// Step is the name of the finalization step. For tables this is "table:" followed by the table name and for the tables
+	// of targets it is "target:" followed by the target name, a colon and then "table:" followed by the table name.
+	Step string
+	// Duration is the time it took to complete the step.
+	Duration time.Duration
+}
+
+// finalize_statements maps finalization steps to the SQL statement they execute.
+var finalize_statements = map[string]string{
+	FINALIZE_ANALYZE:  "ANALYZE",
+	FINALIZE_OPTIMIZE: "PRAGMA OPTIMIZE",
+	FINALIZE_VACUUM:   "VACUUM",
+}
+
+// isValidFinalizeStep returns a boolean value indicating whether 'step' is a known finalization step.
+func isValidFinalizeStep(step string) bool {
+
+	switch step {
+	case FINALIZE_INTEGRITY_CHECK, FINALIZE_CREATE_INDEXES:
+		return true
+	}
+
+	_, ok := finalize_statements[step]
+	return ok
+}
+
+// finalize invokes the `Finalize` method of each of the indexer's tables that implement the `FinalizableTable`
+// interface and then each of the indexer's finalization steps, in order, recording how long each one took along
+// with the timings for the tables of any targets. Finalization steps are only performed on the indexer's database.
+func (idx *SQLiteIndexer) finalize(ctx context.Context, run *indexRun) error {
+
+	// The tables of any targets have already been finalized
+
+	timings := make([]*FinalizeTiming, 0)
+	timings = append(timings, run.target_timings...)
+
+	defer func() {
+		idx.mu.Lock()
+		idx.finalize_timings = timings
+		idx.mu.Unlock()
+	}()
+
+	record_timing := func(step string, t1 time.Time) {
+		timings = append(timings, idx.finalizeTiming(step, t1))
+	}
+
+	idx.db.Lock(ctx)
+	defer idx.db.Unlock(ctx)
+
+	table_timings, err := idx.finalizeTables(ctx, run, idx.db, idx.tables, "")
+
+	timings = append(timings, table_timings...)
+
+	if err != nil {
+		return err
+	}
+
+	if len(idx.finalize_steps) == 0 {
+		return nil
+	}
+
+	conn, err := idx.db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	for _, step := range idx.finalize_steps {
+
+		t1 := time.Now()
+
+		switch step {
+		case FINALIZE_INTEGRITY_CHECK:
+			err = checkIntegrity(ctx, conn, "main")
+		case FINALIZE_CREATE_INDEXES:
+			err = createIndexes(ctx, conn, run.deferred_indexes)
+
+			if err == nil {
+				run.deferred_indexes = nil
+			}
+		default:
+			_, err = conn.ExecContext(ctx, finalize_statements[step])
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to finalize database (%s), %w", step, err)
+		}
+
+		record_timing(step, t1)
+	}
+
+	return nil
+}
+
+// finalizeTables invokes the `Finalize` method of each of 'tables' that implements the `FinalizableTable` interface
+// with 'db', which is expected to have been locked by the caller, and returns how long each one took. The name of each
+// step is "table:" followed by the table name, prefixed with 'prefix'.
+func (idx *SQLiteIndexer) finalizeTables(ctx context.Context, run *indexRun, db sqlite.Database, tables []sqlite.Table, prefix string) ([]*FinalizeTiming, error) {
+
+	timings := make([]*FinalizeTiming, 0)
+
+	for _, t := range tables {
+
+		ft, ok := t.(FinalizableTable)
+
+		if !ok {
+			continue
+		}
+
+		t1 := time.Now()
+
+		err := idx.safeCall(ctx, run, nil, t.Name(), func(ctx context.Context) error {
+
+			return withGuardedDatabase(ctx, db, func(ctx context.Context) error {
+				return ft.Finalize(ctx, db)
+			})
+		})
+
+		if err != nil {
+			return timings, fmt.Errorf("Failed to finalize '%s' table, %w", t.Name(), err)
+		}
+
+		timings = append(timings, idx.finalizeTiming(fmt.Sprintf("%stable:%s", prefix, t.Name()), t1))
+	}
+
+	return timings, nil
+}
+
+// finalizeTargets invokes the `Finalize` method of each of the tables of each of the targets in 'run' that implement
+// the `FinalizableTable` interface, in the target's database or in each of its shards, and stores how long each one
+// took in 'run'. It is expected to be called once all the records in 'run' have been written to the targets.
+func (idx *SQLiteIndexer) finalizeTargets(ctx context.Context, run *indexRun) error {
+
+	for _, state := range run.targets {
+
+		t := state.target
+		dbs := []sqlite.Database{t.DB}
+
+		if state.shards != nil {
+
+			dbs = make([]sqlite.Database, len(state.shards.shards))
+
+			for i, s := range state.shards.shards {
+				dbs[i] = s.db
+			}
+		}
+
+		for _, db := range dbs {
+
+			db.Lock(ctx)
+			timings, err := idx.finalizeTables(ctx, run, db, t.Tables, fmt.Sprintf("target:%s:", t.Name))
+			db.Unlock(ctx)
+
+			run.target_timings = append(run.target_timings, timings...)
+
+			if err != nil {
+				return fmt.Errorf("Failed to finalize '%s' target, %w", t.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// finalizeTiming returns a new `FinalizeTiming` instance for 'step', which started at 't1', logging it if necessary.
+func (idx *SQLiteIndexer) finalizeTiming(step string, t1 time.Time) *FinalizeTiming {
+
+	t2 := time.Since(t1)
+
+	if idx.Timings {
+		idx.logger().Info("Time to finalize", "step", step, "duration", t2)
+	}
+
+	return &FinalizeTiming{Step: step, Duration: t2}
+}
+
+// hasFinalizeStep returns a boolean value indicating whether 'step' is one of the indexer's finalization steps.
+func (idx *SQLiteIndexer) hasFinalizeStep(step string) bool {
+
+	for _, s := range idx.finalize_steps {
+
+		if s == step {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deferIndexes drops the indexes of each of the indexer's tables, storing the statements used to create them in 'run'
+// so that they can be created again by the FINALIZE_CREATE_INDEXES step. Indexes created automatically by SQLite
+// (for example for UNIQUE constraints) can not be dropped and are left as-is.
+func (idx *SQLiteIndexer) deferIndexes(ctx context.Context, run *indexRun) error {
+
+	idx.db.Lock(ctx)
+	defer idx.db.Unlock(ctx)
+
+	conn, err := idx.db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	for _, t := range idx.tables {
+
+		rows, err := conn.QueryContext(ctx, "SELECT name, sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL ORDER BY name", t.Name())
+
+		if err != nil {
+			return fmt.Errorf("Failed to list indexes for '%s' table, %w", t.Name(), err)
+		}
+
+		names := make([]string, 0)
+		statements := make([]string, 0)
+
+		for rows.Next() {
+
+			var name string
+			var stmt string
+
+			err := rows.Scan(&name, &stmt)
+
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("Failed to read indexes for '%s' table, %w", t.Name(), err)
+			}
+
+			names = append(names, name)
+			statements = append(statements, stmt)
+		}
+
+		err = rows.Close()
+
+		if err != nil {
+			return fmt.Errorf("Failed to read indexes for '%s' table, %w", t.Name(), err)
+		}
+
+		for i, name := range names {
+
+			_, err := conn.ExecContext(ctx, fmt.Sprintf(`DROP INDEX IF EXISTS "%s"`, strings.ReplaceAll(name, `"`, `""`)))
+
+			if err != nil {
+				return fmt.Errorf("Failed to drop '%s' index, %w", name, err)
+			}
+
+			run.deferred_indexes = append(run.deferred_indexes, statements[i])
+		}
+	}
+
+	run.logger.Info("Deferred indexes", "count", len(run.deferred_indexes))
+	return nil
+}
+
+// restoreIndexes creates any indexes that were deferred during 'run' but not created again because the run failed
+// before the FINALIZE_CREATE_INDEXES step was performed.
+func (idx *SQLiteIndexer) restoreIndexes(ctx context.Context, run *indexRun) {
+
+	if len(run.deferred_indexes) == 0 {
+		return
+	}
+
+	idx.db.Lock(ctx)
+	defer idx.db.Unlock(ctx)
+
+	conn, err := idx.db.Conn(ctx)
+
+	if err == nil {
+		err = createIndexes(ctx, conn, run.deferred_indexes)
+	}
+
+	if err != nil {
+		run.logger.Error("Failed to restore deferred indexes", "error", err)
+		return
+	}
+
+	run.deferred_indexes = nil
+}
+
+// createIndexes executes each of the CREATE INDEX 'statements'.
+func createIndexes(ctx context.Context, conn *sql.DB, statements []string) error {
+
+	for _, stmt := range statements {
+
+		_, err := conn.ExecContext(ctx, stmt)
+
+		if err != nil {
+			return fmt.Errorf("Failed to create index (%s), %w", stmt, err)
+		}
+	}
+
+	return nil
+}
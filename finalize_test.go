@@ -0,0 +1,137 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"io"
+	"testing"
+)
+
+type FinalizableExampleTable struct {
+	sqlite.Table
+}
+
+func (t *FinalizableExampleTable) Finalize(ctx context.Context, db sqlite.Database) error {
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS example_by_id ON example (id)")
+	return err
+}
+
+func TestFinalize(t *testing.T) {
+
+	f := newTestFixture(t, "finalize.db")
+
+	idx := f.indexer(t, &SQLiteIndexerOptions{
+		Tables:   []sqlite.Table{&FinalizableExampleTable{f.example}},
+		Finalize: []string{FINALIZE_ANALYZE, FINALIZE_OPTIMIZE, FINALIZE_INTEGRITY_CHECK},
+	})
+
+	err := idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	if err != nil {
+		t.Fatalf("Failed to index URIs, %v", err)
+	}
+
+	timings := idx.FinalizeTimings()
+
+	if len(timings) != 4 {
+		t.Fatalf("Expected 4 finalization timings, got %d", len(timings))
+	}
+
+	if timings[0].Step != "table:example" {
+		t.Fatalf("Expected tables to be finalized first, got '%s'", timings[0].Step)
+	}
+
+	if f.count(t, f.db, "SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND name='example_by_id'") != 1 {
+		t.Fatalf("Expected deferred index to be created")
+	}
+
+	_, err = NewSQLiteIndexer(&SQLiteIndexerOptions{Finalize: []string{"reindex"}})
+
+	if err == nil {
+		t.Fatalf("Expected invalid finalization step to fail")
+	}
+}
+
+func TestFinalizeCreateIndexes(t *testing.T) {
+
+	f := newTestFixture(t, "indexes.db")
+
+	conn, err := f.db.Conn(f.ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to establish database connection, %v", err)
+	}
+
+	_, err = conn.ExecContext(f.ctx, "CREATE INDEX example_by_id ON example (id)")
+
+	if err != nil {
+		t.Fatalf("Failed to create index, %v", err)
+	}
+
+	countIndexes := func() int {
+		return f.count(t, f.db, "SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND name='example_by_id'")
+	}
+
+	dropped := -1
+
+	record_func := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+
+		// The database lock is not held while records are loaded
+
+		if dropped == -1 {
+			dropped = countIndexes()
+		}
+
+		return exampleRecord(ctx, path, r, args...)
+	}
+
+	idx := f.indexer(t, &SQLiteIndexerOptions{
+		LoadRecordFunc: record_func,
+		Finalize:       []string{FINALIZE_CREATE_INDEXES, FINALIZE_ANALYZE},
+	})
+
+	err = idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	if err != nil {
+		t.Fatalf("Failed to index URIs, %v", err)
+	}
+
+	if dropped != 0 {
+		t.Fatalf("Expected index to be dropped while indexing")
+	}
+
+	if countIndexes() != 1 {
+		t.Fatalf("Expected deferred index to be created")
+	}
+
+	if idx.FinalizeTimings()[0].Step != FINALIZE_CREATE_INDEXES {
+		t.Fatalf("Expected deferred indexes to be timed")
+	}
+
+	// Deferred indexes are created again even if the run fails
+
+	idx = f.indexer(t, &SQLiteIndexerOptions{
+		LoadRecordFunc: func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+			return nil, fmt.Errorf("Invalid record")
+		},
+		Finalize: []string{FINALIZE_CREATE_INDEXES},
+	})
+
+	err = idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	if err == nil {
+		t.Fatalf("Expected invalid record to fail")
+	}
+
+	if countIndexes() != 1 {
+		t.Fatalf("Expected deferred index to be restored after failed run")
+	}
+}
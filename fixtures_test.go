@@ -0,0 +1,160 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	_ "github.com/aaronland/go-sqlite-modernc"
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/aaronland/go-sqlite/v2/tables"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// PathExample is a record containing the path it was loaded from.
+type PathExample struct {
+	Path string `json:"path"`
+}
+
+// testFixture is a struct containing the scaffolding shared by tests that index records: the current working
+// directory (whose files are used as records), a temporary directory and a file-backed database with the example
+// table initialized in it.
+type testFixture struct {
+	ctx     context.Context
+	cwd     string
+	tmpdir  string
+	db      sqlite.Database
+	example sqlite.Table
+}
+
+// newTestFixture returns a new `testFixture` instance whose database is called 'name'. The database is closed
+// when the test completes.
+func newTestFixture(t *testing.T, name string) *testFixture {
+
+	t.Helper()
+
+	cwd, err := os.Getwd()
+
+	if err != nil {
+		t.Fatalf("Failed to get current working directory, %v", err)
+	}
+
+	f := &testFixture{
+		ctx:    context.Background(),
+		cwd:    cwd,
+		tmpdir: t.TempDir(),
+	}
+
+	f.db = f.openDatabase(t, name)
+
+	ex_t, err := tables.NewExampleTableWithDatabase(f.ctx, f.db)
+
+	if err != nil {
+		t.Fatalf("Failed to create example table, %v", err)
+	}
+
+	f.example = ex_t
+	return f
+}
+
+// openDatabase opens the database called 'name' in the fixture's temporary directory. The database is closed
+// when the test completes.
+func (f *testFixture) openDatabase(t *testing.T, name string) sqlite.Database {
+
+	t.Helper()
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(f.tmpdir, name))
+
+	db, err := sqlite.NewDatabase(f.ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+	}
+
+	t.Cleanup(func() {
+		db.Close(f.ctx)
+	})
+
+	return db
+}
+
+// path returns the path of 'elements' relative to the fixture's working directory.
+func (f *testFixture) path(elements ...string) string {
+	return filepath.Join(append([]string{f.cwd}, elements...)...)
+}
+
+// count returns the (integer) result of the query 'q' against 'db'.
+func (f *testFixture) count(t *testing.T, db sqlite.Database, q string, args ...interface{}) int {
+
+	t.Helper()
+
+	conn, err := db.Conn(f.ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to establish database connection, %v", err)
+	}
+
+	var n int
+
+	err = conn.QueryRowContext(f.ctx, q, args...).Scan(&n)
+
+	if err != nil {
+		t.Fatalf("Failed to query database (%s), %v", q, err)
+	}
+
+	return n
+}
+
+// indexer returns a new `SQLiteIndexer` for 'opts', defaulting to the fixture's database, the example table and the
+// `exampleRecord` loader.
+func (f *testFixture) indexer(t *testing.T, opts *SQLiteIndexerOptions) *SQLiteIndexer {
+
+	t.Helper()
+
+	if opts.DB == nil && !opts.DryRun {
+		opts.DB = f.db
+	}
+
+	if opts.Tables == nil {
+		opts.Tables = []sqlite.Table{f.example}
+	}
+
+	if opts.LoadRecordFunc == nil {
+		opts.LoadRecordFunc = exampleRecord
+	}
+
+	idx, err := NewSQLiteIndexer(opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create sqlite indexer because %v", err)
+	}
+
+	return idx
+}
+
+// exampleRecord is a `SQLiteIndexerLoadRecordFunc` that returns an `Example` record for every path.
+func exampleRecord(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+	return Example{Time: time.Now().Unix()}, nil
+}
+
+// pathRecord is a `SQLiteIndexerLoadRecordFunc` that returns a JSON-encoded `PathExample` record for every path.
+func pathRecord(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+	return json.Marshal(PathExample{Path: path})
+}
+
+// pathKey is a `SQLiteIndexerKeyFunc` that returns the path of records produced by `pathRecord`.
+func pathKey(record interface{}) (string, error) {
+
+	var ex PathExample
+
+	err := json.Unmarshal(record.([]byte), &ex)
+
+	if err != nil {
+		return "", err
+	}
+
+	return ex.Path, nil
+}
@@ -1,21 +1,21 @@
 module github.com/whosonfirst/go-whosonfirst-sqlite-index/v4
 
-go 1.18
+go 1.21
 
 require (
+	github.com/aaronland/go-json-query v0.1.3
 	github.com/aaronland/go-sqlite-modernc v0.0.1
 	github.com/aaronland/go-sqlite/v2 v2.2.0
+	github.com/google/uuid v1.3.0
+	github.com/mattn/go-isatty v0.0.16
+	github.com/tidwall/gjson v1.14.3
 	github.com/whosonfirst/go-whosonfirst-iterate/v2 v2.3.1
 )
 
 require (
-	github.com/aaronland/go-json-query v0.1.3 // indirect
 	github.com/aaronland/go-roster v1.0.0 // indirect
-	github.com/google/uuid v1.3.0 // indirect
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
-	github.com/mattn/go-isatty v0.0.16 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20200410134404-eec4a21b6bb0 // indirect
-	github.com/tidwall/gjson v1.14.3 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
 	github.com/whosonfirst/go-ioutil v1.0.2 // indirect
@@ -4,10 +4,9 @@ import (
 	"context"
 	"fmt"
 	"github.com/aaronland/go-sqlite/v2"
-	"github.com/whosonfirst/go-whosonfirst-iterate/v2/emitter"
-	"github.com/whosonfirst/go-whosonfirst-iterate/v2/iterator"
 	"io"
 	"log"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,16 +19,85 @@ type SQLiteIndexerPostIndexFunc func(context.Context, sqlite.Database, []sqlite.
 // for each record processed by the `IndexURIs` method.
 type SQLiteIndexerLoadRecordFunc func(context.Context, string, io.ReadSeeker, ...interface{}) (interface{}, error)
 
+// loadedRecord is a struct containing a record returned by a `SQLiteIndexerLoadRecordFunc` function and the details needed to index it.
+type loadedRecord struct {
+	// key is the unique key for the record. It is empty unless the indexer requires keys or one has been derived by the `describe` method.
+	key string
+	// source is the offset of the source that produced the record.
+	source int
+	// path is the path of the record, as reported by its source.
+	path string
+	// hash is the SHA-256 hash of the record's raw content. It is empty unless provenance is being tracked.
+	hash string
+	// record is the record itself.
+	record interface{}
+	// load is the time it took to load the record.
+	load time.Duration
+}
+
 // SQLiteIndexer is a struct that provides methods for indexing records in one or more SQLite database tables
 type SQLiteIndexer struct {
-	// iterator_callback is the `whosonfirst/go-whosonfirst-iterate/v2` callback function used by the `IndexPaths` method
-	iterator_callback emitter.EmitterCallbackFunc
-	table_timings     map[string]time.Duration
-	mu                *sync.RWMutex
+	db                    sqlite.Database
+	tables                []sqlite.Table
+	load_record_func      SQLiteIndexerLoadRecordFunc
+	post_index_func       SQLiteIndexerPostIndexFunc
+	key_func              SQLiteIndexerKeyFunc
+	lastmod_func          SQLiteIndexerLastModifiedFunc
+	require_keys          bool
+	precedence            string
+	reproducible          bool
+	pragma_profile        string
+	swap_path             string
+	swap_integrity_check  bool
+	finalize_steps        []string
+	migrate_schemas       bool
+	schema_baselines      map[string]int
+	table_modes           map[string]string
+	record_runs           bool
+	track_provenance      bool
+	table_routes          map[string]SQLiteIndexerRoutingFunc
+	table_policies        map[string]*TablePolicy
+	table_failures        map[string]int64
+	load_timeout          time.Duration
+	table_timeout         time.Duration
+	table_timeouts        map[string]time.Duration
+	slow_record_threshold time.Duration
+	slow_records          []*SlowRecord
+	retry_policy          *RetryPolicy
+	retries               int64
+	pre_scan              bool
+	progress_func         ProgressFunc
+	progress_interval     time.Duration
+	dry_run               bool
+	dry_run_db            sqlite.Database
+	validators            []Validator
+	validation_policy     string
+	limit                 int64
+	sample_rate           float64
+	sample_seed           int64
+	targets               []*Target
+	target_stats          map[string]*TargetStats
+	stats                 *RunStats
+	record_errors         []error
+	conflicts             []*Conflict
+	finalize_timings      []*FinalizeTiming
+	table_timings         map[string]time.Duration
+	mu                    *sync.RWMutex
+	legacy_logger         atomic.Pointer[legacyLogger]
 	// Timings is a boolean flag indicating whether timings (time to index records) should be recorded)
 	Timings bool
-	// Logger is a `log.Logger` instance
+	// ConcurrentSources is a boolean flag indicating whether the sources passed to the `IndexSources` method
+	// should be processed concurrently rather than in order.
+	ConcurrentSources bool
+	// Logger is a `log.Logger` instance. It is only used if `StructuredLogger` is nil in which case messages (at or above
+	// the info level) are written to it as key=value pairs.
+	//
+	// Deprecated: Use StructuredLogger instead.
 	Logger *log.Logger
+	// StructuredLogger is an optional `log/slog.Logger` instance used to log messages. Messages about individual records
+	// are logged at the debug level, progress at the info level, skipped records at the warn level and failures at the
+	// error level. Where relevant messages include "run_id", "path", "key", "table" and "duration" attributes.
+	StructuredLogger *slog.Logger
 }
 
 // SQLiteIndexerOptions
@@ -43,82 +111,336 @@ type SQLiteIndexerOptions struct {
 	LoadRecordFunc SQLiteIndexerLoadRecordFunc
 	// PostIndexFunc is an optional custom function to invoke after a record has been indexed.
 	PostIndexFunc SQLiteIndexerPostIndexFunc
+	// KeyFunc is an optional custom function to derive a unique key for each record. Keys are used to resolve duplicate
+	// records, to sort records in reproducible builds, to track provenance and to identify records in errors and log
+	// messages. If nil the `WOFKeyFunc` function is used.
+	KeyFunc SQLiteIndexerKeyFunc
+	// Precedence is an optional policy used to decide which record to keep when more than one record with the same key
+	// is encountered during a run. Valid options are: PRECEDENCE_FIRST_SEEN, PRECEDENCE_SOURCE_ORDER, PRECEDENCE_LASTMODIFIED.
+	Precedence string
+	// LastModifiedFunc is an optional custom function to derive the last modified time of each record when `Precedence`
+	// is PRECEDENCE_LASTMODIFIED. If nil the `WOFLastModifiedFunc` function is used.
+	LastModifiedFunc SQLiteIndexerLastModifiedFunc
+	// Reproducible is an optional boolean flag signaling that records should be written in a deterministic order (sorted
+	// by key) so that repeated runs against the same data produce byte-identical databases. Records are still loaded in
+	// parallel but are held in memory until all the sources have been iterated.
+	Reproducible bool
+	// PragmaProfile is the optional name of a set of pragmas to apply to the database before each run (and, where
+	// appropriate, revert afterwards). Valid options are: PRAGMA_PROFILE_BULK_LOAD, PRAGMA_PROFILE_WAL, PRAGMA_PROFILE_SAFE.
+	PragmaProfile string
+	// SwapPath is the optional path of a published database file. If present, when a run succeeds, the database being
+	// indexed (typically an in-memory or scratch database) is copied to a temporary file alongside SwapPath which is then
+	// atomically renamed to SwapPath. If the run fails the file at SwapPath is left untouched.
+	SwapPath string
+	// SwapIntegrityCheck is an optional boolean flag signaling that `PRAGMA integrity_check` should be run against the
+	// copy of the database before it is renamed to SwapPath.
+	SwapIntegrityCheck bool
+	// Finalize is an optional list of steps to perform, in order, after all the records in a run have been indexed (and
+	// after any tables implementing the `FinalizableTable` interface have been finalized). Valid options are: FINALIZE_CREATE_INDEXES,
+	// FINALIZE_ANALYZE, FINALIZE_OPTIMIZE, FINALIZE_VACUUM, FINALIZE_INTEGRITY_CHECK.
+	Finalize []string
+	// MigrateSchemas is an optional boolean flag signaling that pending migrations for tables implementing the
+	// `VersionedTable` interface should be applied before indexing. If false, and a table's schema is out of
+	// date, indexing will fail.
+	MigrateSchemas bool
+	// SchemaBaselines is an optional map of table names and the schema version to assume for tables implementing the
+	// `VersionedTable` interface that already contain rows but have no recorded schema version (for example, tables
+	// created before versioning was introduced). Migrations after the baseline version are applied as usual. Baselines
+	// also apply to the tables, with the same name, of any targets.
+	SchemaBaselines map[string]int
+	// TableModes is an optional map of table names and the mode used to prepare that table at the start of each run.
+	// Valid options are: TABLE_MODE_APPEND (the default), TABLE_MODE_TRUNCATE, TABLE_MODE_RECREATE. Modes also apply to
+	// the tables, with the same name, of any unsharded targets. Shards are created from scratch so they are never prepared.
+	TableModes map[string]string
+	// RecordRuns is an optional boolean flag signaling that metadata about each run (its unique ID, start and end times,
+	// sources, tables, record counts and any error) should be written to the `_index_runs` table in `DB`. Runs are not
+	// recorded in the databases of any targets. Note that this will prevent reproducible builds from being byte-identical.
+	RecordRuns bool
+	// TrackProvenance is an optional boolean flag signaling that, for each record that is indexed, its key, path, iterator
+	// URI, run ID, content hash, the time it was indexed (the time the run started) and the tables it was written to should
+	// be recorded in the `_record_sources` table. Note that, since each run has a unique ID and start time, this will prevent
+	// reproducible builds from being byte-identical.
+	TrackProvenance bool
+	// TableRoutes is an optional map of table names and a `SQLiteIndexerRoutingFunc` function used to decide whether
+	// a record should be indexed in that table. Tables without a routing function index every record.
+	TableRoutes map[string]SQLiteIndexerRoutingFunc
+	// TablePolicies is an optional map of table names and the `TablePolicy` used to handle failures to index records in
+	// that table. Tables without a policy are treated as TABLE_POLICY_REQUIRED. Panics inside a table's `IndexRecord` method
+	// are recovered, as a `PanicError`, and handled in the same way as any other failure, as are errors returned by a
+	// table's routing function. Records that fail in every table they are routed to are counted as failed.
+	TablePolicies map[string]*TablePolicy
+	// LoadTimeout is the optional maximum amount of time to wait for `LoadRecordFunc` to load an individual record. Records
+	// that take longer fail to load. Timeouts are signaled using the context passed to `LoadRecordFunc`, which is expected to
+	// honour it, and the indexer waits for `LoadRecordFunc` to return.
+	LoadTimeout time.Duration
+	// TableTimeout is the optional maximum amount of time to wait for a table to index an individual record. Records that take
+	// longer are treated as a failure to index the record in that table, according to the table's policy, even if `IndexRecord`
+	// does not return an error. Timeouts are signaled
+	// using the context passed to the table's `IndexRecord` method, which tables are expected to honour. The database lock is
+	// held until `IndexRecord` returns so tables that ignore the context can not be interrupted.
+	TableTimeout time.Duration
+	// TableTimeouts is an optional map of table names and the timeout for that table, superseding `TableTimeout`.
+	TableTimeouts map[string]time.Duration
+	// SlowRecordThreshold is an optional duration after which records whose load time, or time to index in any table, exceeds
+	// it are logged and reported by the `SlowRecords` method. Slow loads are reported even if the record is then skipped or rejected.
+	SlowRecordThreshold time.Duration
+	// RetryPolicy is an optional `RetryPolicy` used to retry writes that fail with a transient database error, for example
+	// when another process is reading from or backing up the database. If nil `DefaultRetryPolicy` is used.
+	RetryPolicy *RetryPolicy
+	// StructuredLogger is an optional `log/slog.Logger` instance used to log messages. If nil messages are written to
+	// the indexer's (legacy) `Logger` field.
+	StructuredLogger *slog.Logger
+	// PreScan is an optional boolean flag signaling that sources should be iterated, without loading any records, before
+	// indexing in order to determine the total number of records to process. Sources that read from STDIN can not be pre-scanned.
+	PreScan bool
+	// ProgressFunc is an optional `ProgressFunc` function to invoke every `ProgressInterval` with the progress of the run.
+	// If the total number of records is not known (see `PreScan`) only the rate is reported.
+	ProgressFunc ProgressFunc
+	// ProgressInterval is the interval at which to invoke `ProgressFunc`. If zero it defaults to one second.
+	ProgressInterval time.Duration
+	// DryRun is an optional boolean flag signaling that records should be iterated and loaded, and the resulting statistics
+	// and errors reported by the `Stats` and `Errors` methods, without touching `DB`. Errors for individual records do not
+	// stop the run. Pragmas, table modes, migrations, provenance, the post index function, run records, finalization and
+	// swapping are all skipped.
+	DryRun bool
+	// DryRunDatabase is an optional (throwaway) `aaronland/go-sqlite.Database` instance, for example an in-memory database,
+	// that tables are initialized in, and records are indexed in, during a dry run. If nil tables are not invoked during a dry run.
+	DryRunDatabase sqlite.Database
+	// Validators is an optional list of `Validator` instances that each record must pass before it is indexed. See also `WOFValidators`.
+	Validators []Validator
+	// ValidationPolicy is the policy used to handle records that fail validation. Valid options are: TABLE_POLICY_REQUIRED (the
+	// default), where an invalid record stops the run, and TABLE_POLICY_BEST_EFFORT, where invalid records are logged and skipped.
+	ValidationPolicy string
+	// Limit is the optional maximum number of records to process. Once it has been reached the iteration of every source
+	// is stopped. If sources are processed concurrently which records are processed is not deterministic.
+	Limit int64
+	// SampleRate is the optional fraction (greater than 0 and less than 1) of records to process. Whether or not a record
+	// is included in the sample is derived from a hash of its path, relative to the source URI it was found in, and
+	// `SampleSeed` so the same records are processed every time, wherever the source is located. Records that are excluded by the sample, or by `Limit`, are ignored and not counted in the run's statistics.
+	SampleRate float64
+	// SampleSeed is an optional seed used to select a different (but still deterministic) sample of records.
+	SampleSeed int64
+	// Targets is an optional list of additional `Target` databases that records are indexed in. Each record is loaded
+	// once and then indexed in `DB` and in every target whose predicate it matches. Targets are written to after `DB`,
+	// in the same order, and each target has its own lock and (optional) lock batching. Records are not written to a target
+	// if they are superseded by another record (see `Precedence`) or if they fail to be indexed in `DB`. Failures to
+	// index a record in a target are counted in that target's statistics rather than the run's and stop the run, with a
+	// `TargetError`, once the rest of the records queued for that target have been written. Targets are skipped during a dry run.
+	Targets []*Target
 }
 
 // NewSQLiteInder returns a `SQLiteIndexer` configured with 'opts'.
 func NewSQLiteIndexer(opts *SQLiteIndexerOptions) (*SQLiteIndexer, error) {
 
-	db := opts.DB
-	tables := opts.Tables
-	record_func := opts.LoadRecordFunc
+	if opts.PragmaProfile != "" {
 
-	table_timings := make(map[string]time.Duration)
-	mu := new(sync.RWMutex)
+		_, ok := pragma_profiles[opts.PragmaProfile]
 
-	logger := log.Default()
+		if !ok {
+			return nil, fmt.Errorf("Invalid pragma profile '%s'", opts.PragmaProfile)
+		}
+	}
+
+	for name, _ := range opts.TableRoutes {
+
+		if !hasTableNamed(opts.Tables, name) {
+			return nil, fmt.Errorf("Routing function defined for unknown table '%s'", name)
+		}
+	}
+
+	for name, p := range opts.TablePolicies {
 
-	iterator_cb := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) error {
+		if !hasTableNamed(opts.Tables, name) {
+			return nil, fmt.Errorf("Table policy defined for unknown table '%s'", name)
+		}
+
+		if p == nil {
+			return nil, fmt.Errorf("Empty policy for '%s' table", name)
+		}
 
-		record, err := record_func(ctx, path, r, args...)
+		err := p.validate()
 
 		if err != nil {
-			logger.Printf("Failed to load record (%s) because %s", path, err)
-			return err
+			return nil, fmt.Errorf("Invalid policy for '%s' table, %w", name, err)
 		}
+	}
 
-		if record == nil {
-			return nil
+	for name, timeout := range opts.TableTimeouts {
+
+		if !hasTableNamed(opts.Tables, name) {
+			return nil, fmt.Errorf("Timeout defined for unknown table '%s'", name)
 		}
 
-		db.Lock(ctx)
-		defer db.Unlock(ctx)
+		if timeout < 0 {
+			return nil, fmt.Errorf("Invalid timeout for '%s' table, %v", name, timeout)
+		}
+	}
 
-		for _, t := range tables {
+	if opts.LoadTimeout < 0 || opts.TableTimeout < 0 || opts.SlowRecordThreshold < 0 {
+		return nil, fmt.Errorf("Timeouts and thresholds must not be negative")
+	}
 
-			t1 := time.Now()
+	for name, version := range opts.SchemaBaselines {
 
-			err = t.IndexRecord(ctx, db, record)
+		if !hasTableNamed(opts.Tables, name) && !hasTargetTableNamed(opts.Targets, name) {
+			return nil, fmt.Errorf("Schema baseline defined for unknown table '%s'", name)
+		}
 
-			if err != nil {
-				logger.Printf("Failed to index feature (%s) in '%s' table because %s", path, t.Name(), err)
-				return err
-			}
+		if version < 1 {
+			return nil, fmt.Errorf("Invalid schema baseline for '%s' table, %d", name, version)
+		}
+	}
 
-			t2 := time.Since(t1)
+	for name, mode := range opts.TableModes {
 
-			n := t.Name()
+		if !hasTableNamed(opts.Tables, name) && !hasTargetTableNamed(opts.Targets, name) {
+			return nil, fmt.Errorf("Table mode defined for unknown table '%s'", name)
+		}
 
-			mu.Lock()
+		if !isValidTableMode(mode) {
+			return nil, fmt.Errorf("Invalid table mode '%s' for '%s' table", mode, name)
+		}
+	}
 
-			_, ok := table_timings[n]
+	for _, step := range opts.Finalize {
 
-			if ok {
-				table_timings[n] += t2
-			} else {
-				table_timings[n] = t2
-			}
+		if !isValidFinalizeStep(step) {
+			return nil, fmt.Errorf("Invalid finalization step '%s'", step)
+		}
+	}
+
+	if opts.Precedence != "" {
 
-			mu.Unlock()
+		if !isValidPrecedence(opts.Precedence) {
+			return nil, fmt.Errorf("Invalid precedence policy '%s'", opts.Precedence)
 		}
+	}
 
-		if opts.PostIndexFunc != nil {
+	retry_policy := opts.RetryPolicy
 
-			err := opts.PostIndexFunc(ctx, db, tables, record)
+	if retry_policy == nil {
+		retry_policy = DefaultRetryPolicy
+	}
 
-			if err != nil {
-				return err
-			}
+	err := retry_policy.validate()
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retry policy, %w", err)
+	}
+
+	if opts.Limit < 0 {
+		return nil, fmt.Errorf("Limit must not be negative")
+	}
+
+	if opts.SampleRate < 0 || opts.SampleRate > 1 {
+		return nil, fmt.Errorf("Sample rate must be between 0 and 1")
+	}
+
+	target_names := make(map[string]bool)
+
+	for i, t := range opts.Targets {
+
+		if t == nil {
+			return nil, fmt.Errorf("Target at offset %d is empty", i)
 		}
 
-		return nil
+		err := t.validate()
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid target at offset %d, %w", i, err)
+		}
+
+		if target_names[t.Name] {
+			return nil, fmt.Errorf("Duplicate target '%s'", t.Name)
+		}
+
+		target_names[t.Name] = true
+	}
+
+	validation_policy := opts.ValidationPolicy
+
+	if validation_policy == "" {
+		validation_policy = TABLE_POLICY_REQUIRED
+	}
+
+	if !isValidValidationPolicy(validation_policy) {
+		return nil, fmt.Errorf("Invalid validation policy '%s'", validation_policy)
+	}
+
+	progress_interval := opts.ProgressInterval
+
+	if progress_interval < 0 {
+		return nil, fmt.Errorf("Progress interval must not be negative")
+	}
+
+	if progress_interval == 0 {
+		progress_interval = time.Second
+	}
+
+	key_func := opts.KeyFunc
+
+	if key_func == nil {
+		key_func = WOFKeyFunc
+	}
+
+	lastmod_func := opts.LastModifiedFunc
+
+	if lastmod_func == nil {
+		lastmod_func = WOFLastModifiedFunc
 	}
 
+	// Keys are always derived up front if something other than error reporting depends on them.
+	// Otherwise they are only derived (lazily) when something goes wrong.
+
+	require_keys := opts.Precedence != "" || opts.Reproducible || opts.TrackProvenance
+
+	table_timings := make(map[string]time.Duration)
+	mu := new(sync.RWMutex)
+
+	logger := log.Default()
+
 	i := SQLiteIndexer{
-		iterator_callback: iterator_cb,
-		table_timings:     table_timings,
-		mu:                mu,
-		Timings:           false,
-		Logger:            logger,
+		db:                    opts.DB,
+		tables:                opts.Tables,
+		load_record_func:      opts.LoadRecordFunc,
+		post_index_func:       opts.PostIndexFunc,
+		key_func:              key_func,
+		lastmod_func:          lastmod_func,
+		require_keys:          require_keys,
+		precedence:            opts.Precedence,
+		reproducible:          opts.Reproducible,
+		pragma_profile:        opts.PragmaProfile,
+		swap_path:             opts.SwapPath,
+		swap_integrity_check:  opts.SwapIntegrityCheck,
+		finalize_steps:        opts.Finalize,
+		migrate_schemas:       opts.MigrateSchemas,
+		schema_baselines:      opts.SchemaBaselines,
+		table_modes:           opts.TableModes,
+		record_runs:           opts.RecordRuns,
+		track_provenance:      opts.TrackProvenance,
+		table_routes:          opts.TableRoutes,
+		table_policies:        opts.TablePolicies,
+		load_timeout:          opts.LoadTimeout,
+		table_timeout:         opts.TableTimeout,
+		table_timeouts:        opts.TableTimeouts,
+		slow_record_threshold: opts.SlowRecordThreshold,
+		retry_policy:          retry_policy,
+		pre_scan:              opts.PreScan,
+		progress_func:         opts.ProgressFunc,
+		progress_interval:     progress_interval,
+		dry_run:               opts.DryRun,
+		dry_run_db:            opts.DryRunDatabase,
+		validators:            opts.Validators,
+		validation_policy:     validation_policy,
+		limit:                 opts.Limit,
+		sample_rate:           opts.SampleRate,
+		sample_seed:           opts.SampleSeed,
+		targets:               opts.Targets,
+		table_timings:         table_timings,
+		mu:                    mu,
+		Timings:               false,
+		Logger:                logger,
+		StructuredLogger:      opts.StructuredLogger,
 	}
 
 	return &i, nil
@@ -126,67 +448,539 @@ func NewSQLiteIndexer(opts *SQLiteIndexerOptions) (*SQLiteIndexer, error) {
 
 // IndexPaths is deprecated and has been superseded by the `IndexURIs` method.
 func (idx *SQLiteIndexer) IndexPaths(ctx context.Context, iterator_uri string, uris []string) error {
-	idx.Logger.Println("The IndexPaths method is deprecated. Please use IndexURIs instead.")
+	idx.logger().Warn("The IndexPaths method is deprecated. Please use IndexURIs instead.")
 	return idx.IndexURIs(ctx, iterator_uri, uris...)
 }
 
 // IndexURIs will index records returned by the `whosonfirst/go-whosonfirst-iterate` instance for 'uris',
 func (idx *SQLiteIndexer) IndexURIs(ctx context.Context, iterator_uri string, uris ...string) error {
 
-	iter, err := iterator.NewIterator(ctx, iterator_uri, idx.iterator_callback)
+	sources := []Source{
+		Source{
+			IteratorURI: iterator_uri,
+			URIs:        uris,
+		},
+	}
 
-	if err != nil {
-		return fmt.Errorf("Failed to create new iterator, %w", err)
+	return idx.IndexSources(ctx, sources)
+}
+
+// Conflicts returns the list of records with duplicate keys encountered during the most recent run and how they
+// were resolved. It is always empty unless the `Precedence` option was set.
+func (idx *SQLiteIndexer) Conflicts() []*Conflict {
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	conflicts := make([]*Conflict, len(idx.conflicts))
+	copy(conflicts, idx.conflicts)
+
+	return conflicts
+}
+
+// TableFailures returns a map of table names and the number of records that could not be indexed in that table
+// during the most recent run. Only tables with a TABLE_POLICY_BEST_EFFORT or TABLE_POLICY_DISABLE_AFTER policy
+// (that failed at least once) are included.
+func (idx *SQLiteIndexer) TableFailures() map[string]int64 {
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	failures := make(map[string]int64)
+
+	for name, count := range idx.table_failures {
+		failures[name] = count
+	}
+
+	return failures
+}
+
+// Stats returns the counts of records processed during the most recent run.
+func (idx *SQLiteIndexer) Stats() *RunStats {
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if idx.stats == nil {
+		return new(RunStats)
 	}
 
-	done_ch := make(chan bool)
+	stats := *idx.stats
+	return &stats
+}
+
+// TargetStats returns a map of target names and the counts of records processed by that target during the most recent run.
+func (idx *SQLiteIndexer) TargetStats() map[string]*TargetStats {
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	stats := make(map[string]*TargetStats)
+
+	for name, s := range idx.target_stats {
+		ts := *s
+		stats[name] = &ts
+	}
+
+	return stats
+}
+
+// Errors returns the list of errors for individual records encountered during the most recent run, if it was a dry run.
+func (idx *SQLiteIndexer) Errors() []error {
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	errors := make([]error, len(idx.record_errors))
+	copy(errors, idx.record_errors)
+
+	return errors
+}
+
+// Retries returns the number of times an operation was retried after a transient database error during the most recent run.
+func (idx *SQLiteIndexer) Retries() int64 {
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.retries
+}
+
+// SlowRecords returns the list of records whose load time, or time to index in any table, exceeded the slow
+// record threshold during the most recent run, slowest first.
+func (idx *SQLiteIndexer) SlowRecords() []*SlowRecord {
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	records := make([]*SlowRecord, len(idx.slow_records))
+	copy(records, idx.slow_records)
+
+	return records
+}
+
+// FinalizeTimings returns the list of finalization steps performed at the end of the most recent successful
+// run and how long each one took.
+func (idx *SQLiteIndexer) FinalizeTimings() []*FinalizeTiming {
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	timings := make([]*FinalizeTiming, len(idx.finalize_timings))
+	copy(timings, idx.finalize_timings)
+
+	return timings
+}
+
+// indexRecord is the `whosonfirst/go-whosonfirst-iterate/v2` callback function used to load and index
+// an individual record, produced by the source at offset 'source' in 'run', in each of the indexer's tables.
+func (idx *SQLiteIndexer) indexRecord(ctx context.Context, run *indexRun, source int, path string, r io.ReadSeeker, args ...interface{}) error {
+
+	var hash string
+
+	if idx.track_provenance {
+
+		h, err := hashRecord(r)
+
+		if err != nil {
+			run.logger.Error("Failed to hash record", "path", path, "error", err)
+			return &LoadError{Path: path, Err: err}
+		}
+
+		hash = h
+	}
+
+	var record interface{}
+
 	t1 := time.Now()
 
-	// ideally this could be a proper stand-along package method but then
-	// we have to set up a whole bunch of scaffolding just to pass 'indexer'
-	// around so... we're not doing that (20180205/thisisaaronland)
+	err := idx.callWithTimeout(ctx, idx.load_timeout, run, &loadedRecord{path: path}, "", func(ctx context.Context) error {
+		rec, err := idx.load_record_func(ctx, path, r, args...)
+		record = rec
+		return err
+	})
 
-	show_timings := func() {
+	if err != nil {
+		run.logger.Error("Failed to load record", "path", path, "error", err)
+		return &LoadError{Path: path, Err: err}
+	}
+
+	lr := &loadedRecord{
+		source: source,
+		path:   path,
+		hash:   hash,
+		record: record,
+		load:   time.Since(t1),
+	}
 
-		t2 := time.Since(t1)
+	// Records that are written are checked by writeRecord, along with the time it took to index them
+	// in each table, so this only checks the load time of records that are skipped or rejected
 
-		i := atomic.LoadInt64(&iter.Seen)
+	written := false
 
-		idx.mu.RLock()
-		defer idx.mu.RUnlock()
+	defer func() {
 
-		for t, d := range idx.table_timings {
-			idx.Logger.Printf("Time to index %s (%d) : %v", t, i, d)
+		if !written {
+			idx.checkSlowRecord(run, lr, nil)
 		}
+	}()
 
-		idx.Logger.Printf("Time to index all (%d) : %v", i, t2)
+	if record == nil {
+		run.logger.Debug("Skipped empty record", "path", path)
+		atomic.AddInt64(&run.counts.skipped, 1)
+		return nil
 	}
 
-	if idx.Timings {
+	if idx.require_keys {
+
+		key, err := idx.deriveKey(ctx, lr)
+
+		if err != nil {
+			run.logger.Error("Failed to derive key for record", "path", path, "error", err)
+			return &LoadError{Path: path, Err: fmt.Errorf("Failed to derive key, %w", err)}
+		}
+
+		lr.key = key
+	}
 
-		go func() {
+	if len(idx.validators) > 0 {
 
-			for {
+		err := idx.validateRecord(ctx, run, lr)
 
-				select {
-				case <-done_ch:
-					return
-				case <-time.After(1 * time.Minute):
-					show_timings()
-				}
+		if err != nil {
+
+			atomic.AddInt64(&run.counts.invalid, 1)
+
+			if idx.validation_policy == TABLE_POLICY_BEST_EFFORT {
+				run.logger.Warn("Skipped invalid record", "path", path, "key", lr.key, "error", err)
+				atomic.AddInt64(&run.counts.skipped, 1)
+				return nil
 			}
-		}()
 
-		defer func() {
-			done_ch <- true
-		}()
+			run.logger.Error("Invalid record", "path", path, "key", lr.key, "error", err)
+			return err
+		}
 	}
 
-	err = iter.IterateURIs(ctx, uris...)
+	written = true
+
+	if run.buffer != nil {
+		run.buffer.Add(lr)
+		return nil
+	}
+
+	return idx.writeRecord(ctx, run, lr)
+}
+
+// writeRecord indexes 'lr' in each of the indexer's tables (that it is routed to), queues it for each of the indexer's
+// targets and then invokes the post index function, if present. Any target queues that are full are written once
+// the database lock has been released.
+func (idx *SQLiteIndexer) writeRecord(ctx context.Context, run *indexRun, lr *loadedRecord) (err error) {
+
+	record := lr.record
+	t0 := time.Now()
+
+	timings := make(map[string]time.Duration)
+	defer idx.checkSlowRecord(run, lr, timings)
+
+	// Failures to route, or index, the record in tables that are not required are counted
+	// and the record is counted as failed if it was not indexed in any table as a result
+
+	tables, failed, err := idx.routeRecord(ctx, run, lr)
 
 	if err != nil {
 		return err
 	}
 
+	if len(tables) == 0 && failed > 0 {
+		atomic.AddInt64(&run.counts.failed, 1)
+		return nil
+	}
+
+	var full []*targetState
+
+	if len(tables) == 0 && len(run.targets) == 0 {
+		run.logger.Debug("Skipped record not routed to any tables", "path", lr.path)
+		atomic.AddInt64(&run.counts.skipped, 1)
+		return nil
+	}
+
+	if len(run.targets) > 0 {
+
+		// The key is derived now, before the record is queued, since queued records may be
+		// written to targets by other goroutines
+
+		idx.recordKey(lr)
+
+		// This is deferred before the database lock is acquired so that it is run after
+		// the lock has been released
+
+		defer func() {
+
+			target_err := idx.writeTargets(ctx, run, full)
+
+			if err == nil {
+				err = target_err
+			}
+		}()
+	}
+
+	// During a dry run records are written to the dry run database, if present, instead
+
+	db := idx.db
+
+	if idx.dry_run {
+		db = idx.dry_run_db
+	}
+
+	if db != nil {
+		db.Lock(ctx)
+		defer db.Unlock(ctx)
+	}
+
+	// Claims are made while holding the database lock so that the decision to (re)index
+	// a record and the subsequent writes happen atomically
+
+	if run.claims != nil {
+
+		ok, err := idx.claimRecord(ctx, run, lr)
+
+		if err != nil {
+			run.logger.Error("Failed to claim record", "path", lr.path, "key", lr.key, "error", err)
+			return err
+		}
+
+		if !ok {
+			run.logger.Warn("Skipped record superseded by another record", "path", lr.path, "key", lr.key)
+			atomic.AddInt64(&run.counts.skipped, 1)
+			return nil
+		}
+	}
+
+	indexed := make([]string, 0)
+
+	for _, t := range tables {
+
+		// Check again now that we're holding the lock since another record may
+		// have caused the table to be disabled after this one was routed
+
+		if run.failures.IsDisabled(t.Name()) {
+			continue
+		}
+
+		if db == nil {
+			indexed = append(indexed, t.Name())
+			continue
+		}
+
+		t1 := time.Now()
+
+		label := func() string {
+			return fmt.Sprintf("%s in '%s' table", idx.describe(lr), t.Name())
+		}
+
+		err := idx.withRetries(ctx, run, label, func() error {
+
+			return idx.callWithTimeout(ctx, idx.tableTimeout(t.Name()), run, lr, t.Name(), func(ctx context.Context) error {
+
+				return withGuardedDatabase(ctx, db, func(ctx context.Context) error {
+					return t.IndexRecord(ctx, db, record)
+				})
+			})
+		})
+
+		timings[t.Name()] = time.Since(t1)
+
+		if err != nil {
+
+			err = idx.tableFailed(run, lr, t.Name(), err)
+
+			if err != nil {
+				return err
+			}
+
+			failed += 1
+			continue
+		}
+
+		n := t.Name()
+		t2 := timings[n]
+
+		indexed = append(indexed, n)
+
+		idx.mu.Lock()
+
+		_, ok := idx.table_timings[n]
+
+		if ok {
+			idx.table_timings[n] += t2
+		} else {
+			idx.table_timings[n] = t2
+		}
+
+		idx.mu.Unlock()
+	}
+
+	// Records that were routed to tables but could not be indexed in any of them are not written to targets
+
+	if len(run.targets) > 0 && (len(indexed) > 0 || len(tables) == 0) {
+
+		f, err := idx.queueTargets(ctx, run, lr)
+		full = f
+
+		if err != nil {
+			run.logger.Error("Failed to queue record for targets", "path", lr.path, "key", idx.recordKey(lr), "error", err)
+			return err
+		}
+	}
+
+	if len(indexed) == 0 {
+
+		if failed > 0 {
+			atomic.AddInt64(&run.counts.failed, 1)
+		} else {
+			atomic.AddInt64(&run.counts.skipped, 1)
+		}
+
+		return nil
+	}
+
+	if idx.track_provenance && !idx.dry_run {
+
+		label := func() string {
+			return fmt.Sprintf("provenance for %s", idx.describe(lr))
+		}
+
+		err := idx.withRetries(ctx, run, label, func() error {
+			return idx.recordProvenance(ctx, run, lr, indexed)
+		})
+
+		if err != nil {
+			run.logger.Error("Failed to record provenance", "path", lr.path, "key", lr.key, "error", err)
+			return &DatabaseError{Op: "record provenance", Path: lr.path, Key: lr.key, Err: err}
+		}
+	}
+
+	if idx.post_index_func != nil && !idx.dry_run {
+
+		err := idx.safeCall(ctx, run, lr, "", func(ctx context.Context) error {
+
+			return withGuardedDatabase(ctx, idx.db, func(ctx context.Context) error {
+				return idx.post_index_func(ctx, db, idx.tables, record)
+			})
+		})
+
+		if err != nil {
+			return &PostIndexError{Path: lr.path, Key: idx.recordKey(lr), Err: err}
+		}
+	}
+
+	run.logger.Debug("Indexed record", "path", lr.path, "key", lr.key, "tables", indexed, "duration", time.Since(t0))
+
+	atomic.AddInt64(&run.counts.indexed, 1)
 	return nil
 }
+
+// claimRecord claims 'lr' in 'run', deriving its last modified time if necessary, and returns a boolean value
+// indicating whether the record should be indexed.
+func (idx *SQLiteIndexer) claimRecord(ctx context.Context, run *indexRun, lr *loadedRecord) (bool, error) {
+
+	rc := &recordClaim{
+		path:   lr.path,
+		source: lr.source,
+	}
+
+	if idx.precedence == PRECEDENCE_LASTMODIFIED {
+
+		var lastmod int64
+
+		err := idx.safeCall(ctx, run, lr, "", func(ctx context.Context) error {
+			t, err := idx.lastmod_func(lr.record)
+			lastmod = t
+			return err
+		})
+
+		if err != nil {
+			return false, &LoadError{Path: lr.path, Key: lr.key, Err: fmt.Errorf("Failed to derive last modified time, %w", err)}
+		}
+
+		rc.last_modified = lastmod
+	}
+
+	return run.claims.Claim(lr.key, rc), nil
+}
+
+// describe returns a short human-readable description of 'lr' for use in errors and log messages, for example
+// "feature 85922583 (/usr/local/data/whosonfirst-data-admin-ca/data/859/225/83/85922583.geojson)". If a key has
+// not already been derived for the record an attempt is made to do so; if that fails only the path is used.
+func (idx *SQLiteIndexer) describe(lr *loadedRecord) string {
+	return describeRecord(idx.recordKey(lr), lr.path)
+}
+
+// recordKey returns the key for 'lr', deriving (and storing) it if necessary. If the key can not be derived an empty
+// string is returned.
+func (idx *SQLiteIndexer) recordKey(lr *loadedRecord) string {
+
+	if lr.key == "" {
+
+		key, err := idx.deriveKey(context.Background(), lr)
+
+		if err == nil {
+			lr.key = key
+		}
+	}
+
+	return lr.key
+}
+
+// deriveKey returns the key for 'lr' using the indexer's key function, recovering any panics. An empty key is an error.
+func (idx *SQLiteIndexer) deriveKey(ctx context.Context, lr *loadedRecord) (string, error) {
+
+	var key string
+
+	// The record is not passed to safeCall since it would try to derive the key again if the key function panics
+
+	err := idx.safeCall(ctx, nil, &loadedRecord{path: lr.path}, "", func(ctx context.Context) error {
+		k, err := idx.key_func(lr.record)
+		key = k
+		return err
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	// Records with an empty key would otherwise all be treated as the same record
+
+	if key == "" {
+		return "", fmt.Errorf("Key function returned an empty key")
+	}
+
+	return key, nil
+}
+
+// hasTableNamed returns a boolean value indicating whether any of 'tables' is named 'name'.
+func hasTableNamed(tables []sqlite.Table, name string) bool {
+
+	for _, t := range tables {
+
+		if t.Name() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasTargetTableNamed returns a boolean value indicating whether any of 'targets' has a table named 'name'.
+func hasTargetTableNamed(targets []*Target, name string) bool {
+
+	for _, t := range targets {
+
+		if t != nil && hasTableNamed(t.Tables, name) {
+			return true
+		}
+	}
+
+	return false
+}
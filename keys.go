@@ -0,0 +1,158 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"strings"
+)
+
+// SQLiteIndexerKeyFunc is a custom function to derive a unique key for a record returned by a `SQLiteIndexerLoadRecordFunc` function.
+type SQLiteIndexerKeyFunc func(interface{}) (string, error)
+
+// SQLiteIndexerLastModifiedFunc is a custom function to derive the last modified time (as a Unix timestamp) for a record returned
+// by a `SQLiteIndexerLoadRecordFunc` function.
+type SQLiteIndexerLastModifiedFunc func(interface{}) (int64, error)
+
+// wof_id_paths are the `tidwall/gjson` paths checked, in order, for a Who's On First ID.
+var wof_id_paths = []string{
+	"properties.wof:id",
+	"wof:id",
+}
+
+// wof_lastmodified_paths are the `tidwall/gjson` paths checked, in order, for a Who's On First last modified time.
+var wof_lastmodified_paths = []string{
+	"properties.wof:lastmodified",
+	"wof:lastmodified",
+}
+
+// WOFKeyFunc is the default `SQLiteIndexerKeyFunc` function. It returns the value of the `wof:id` property
+// of 'record' which is expected to be a Who's On First GeoJSON Feature (or a flat record with a top-level `wof:id`
+// property) encoded as a byte slice, a string, a `map[string]interface{}` or anything that can be marshaled as JSON.
+// Records whose `wof:id` property is null or empty produce an error.
+func WOFKeyFunc(record interface{}) (string, error) {
+
+	rsp, err := wofProperty(record, wof_id_paths)
+
+	if err != nil {
+		return "", err
+	}
+
+	key := rsp.String()
+
+	if rsp.Type == gjson.Null || key == "" {
+		return "", fmt.Errorf("Record has an empty %s property", wof_id_paths[0])
+	}
+
+	return key, nil
+}
+
+// WOFLastModifiedFunc is the default `SQLiteIndexerLastModifiedFunc` function. It returns the value of the
+// `wof:lastmodified` property of 'record' with the same expectations as `WOFKeyFunc`.
+func WOFLastModifiedFunc(record interface{}) (int64, error) {
+
+	rsp, err := wofProperty(record, wof_lastmodified_paths)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return rsp.Int(), nil
+}
+
+// wofProperty returns the first of 'paths' present in 'record'. JSON-encoded records are read in place and
+// `map[string]interface{}` records are read directly; only records of any other type are marshaled as JSON.
+func wofProperty(record interface{}, paths []string) (gjson.Result, error) {
+
+	m, ok := record.(map[string]interface{})
+
+	if ok {
+		return mapProperty(m, paths)
+	}
+
+	body, err := recordBody(record)
+
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	for _, path := range paths {
+
+		rsp := gjson.GetBytes(body, path)
+
+		if rsp.Exists() {
+			return rsp, nil
+		}
+	}
+
+	return gjson.Result{}, fmt.Errorf("Record is missing %s property", paths[0])
+}
+
+// mapProperty returns the first of 'paths' present in 'm', where each (dot-separated) element of a path is the key
+// of a nested map. Only the value found is marshaled as JSON in order to be returned as a `gjson.Result`.
+func mapProperty(m map[string]interface{}, paths []string) (gjson.Result, error) {
+
+	for _, path := range paths {
+
+		v, ok := mapValue(m, strings.Split(path, "."))
+
+		if !ok {
+			continue
+		}
+
+		enc, err := json.Marshal(v)
+
+		if err != nil {
+			return gjson.Result{}, fmt.Errorf("Failed to marshal %s property, %w", path, err)
+		}
+
+		return gjson.ParseBytes(enc), nil
+	}
+
+	return gjson.Result{}, fmt.Errorf("Record is missing %s property", paths[0])
+}
+
+// mapValue returns the value of 'keys' in 'm' and a boolean value indicating whether it was present.
+func mapValue(m map[string]interface{}, keys []string) (interface{}, bool) {
+
+	v, ok := m[keys[0]]
+
+	if !ok {
+		return nil, false
+	}
+
+	if len(keys) == 1 {
+		return v, true
+	}
+
+	child, ok := v.(map[string]interface{})
+
+	if !ok {
+		return nil, false
+	}
+
+	return mapValue(child, keys[1:])
+}
+
+// recordBody returns the JSON encoding of 'record'. Byte slices, strings and `json.RawMessage` values are assumed
+// to be JSON-encoded already and are returned as-is.
+func recordBody(record interface{}) ([]byte, error) {
+
+	switch r := record.(type) {
+	case []byte:
+		return r, nil
+	case string:
+		return []byte(r), nil
+	case json.RawMessage:
+		return r, nil
+	default:
+
+		body, err := json.Marshal(record)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal record, %w", err)
+		}
+
+		return body, nil
+	}
+}
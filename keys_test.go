@@ -0,0 +1,90 @@
+package index
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWOFKeyFunc(t *testing.T) {
+
+	feature := []byte(`{"type": "Feature", "properties": {"wof:id": 85922583, "wof:lastmodified": 1700000000}, "geometry": null}`)
+
+	records := []interface{}{
+		feature,
+		string(feature),
+		map[string]interface{}{"wof:id": 85922583},
+		map[string]interface{}{"properties": map[string]interface{}{"wof:id": 85922583}, "geometry": func() {}},
+	}
+
+	for _, r := range records {
+
+		key, err := WOFKeyFunc(r)
+
+		if err != nil {
+			t.Fatalf("Failed to derive key for %T, %v", r, err)
+		}
+
+		if key != "85922583" {
+			t.Fatalf("Unexpected key for %T: %s", r, key)
+		}
+	}
+
+	lastmod, err := WOFLastModifiedFunc(feature)
+
+	if err != nil {
+		t.Fatalf("Failed to derive last modified time, %v", err)
+	}
+
+	if lastmod != 1700000000 {
+		t.Fatalf("Unexpected last modified time: %d", lastmod)
+	}
+
+	_, err = WOFKeyFunc(Example{Time: 1})
+
+	if err == nil {
+		t.Fatalf("Expected record without wof:id to fail")
+	}
+
+	empty := []interface{}{
+		[]byte(`{"type": "Feature", "properties": {"wof:id": null}}`),
+		[]byte(`{"type": "Feature", "properties": {"wof:id": ""}}`),
+		map[string]interface{}{"wof:id": nil},
+	}
+
+	for _, r := range empty {
+
+		_, err := WOFKeyFunc(r)
+
+		if err == nil {
+			t.Fatalf("Expected record with empty wof:id to fail, %v", r)
+		}
+	}
+}
+
+func TestEmptyKey(t *testing.T) {
+
+	f := newTestFixture(t, "keys.db")
+
+	empty_key := func(record interface{}) (string, error) {
+		return "", nil
+	}
+
+	// Records with empty keys must not be treated as duplicates of each other
+
+	idx := f.indexer(t, &SQLiteIndexerOptions{
+		KeyFunc:    empty_key,
+		Precedence: PRECEDENCE_SOURCE_ORDER,
+	})
+
+	err := idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	if err == nil {
+		t.Fatalf("Expected empty key to fail")
+	}
+
+	_, err = idx.deriveKey(context.Background(), &loadedRecord{path: "empty.geojson", record: []byte("{}")})
+
+	if err == nil {
+		t.Fatalf("Expected empty key to be rejected")
+	}
+}
@@ -0,0 +1,108 @@
+package index
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+const (
+	// LOG_FORMAT_TEXT signals that log messages should be formatted as key=value pairs.
+	LOG_FORMAT_TEXT string = "text"
+	// LOG_FORMAT_JSON signals that log messages should be formatted as JSON.
+	LOG_FORMAT_JSON string = "json"
+)
+
+// NewStructuredLogger returns a new `slog.Logger` instance that writes messages at or above 'level' to 'wr' using
+// 'format', which must be LOG_FORMAT_TEXT or LOG_FORMAT_JSON.
+func NewStructuredLogger(wr io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+
+	opts := &slog.HandlerOptions{
+		Level: level,
+	}
+
+	var h slog.Handler
+
+	switch format {
+	case LOG_FORMAT_TEXT, "":
+		h = slog.NewTextHandler(wr, opts)
+	case LOG_FORMAT_JSON:
+		h = slog.NewJSONHandler(wr, opts)
+	default:
+		return nil, fmt.Errorf("Invalid log format '%s'", format)
+	}
+
+	return slog.New(h), nil
+}
+
+// legacyWriter is an `io.Writer` that writes each message it receives to a `log.Logger` instance.
+type legacyWriter struct {
+	logger *log.Logger
+}
+
+// Write writes 'p', minus its trailing newline, to the underlying `log.Logger` instance.
+func (w *legacyWriter) Write(p []byte) (int, error) {
+
+	err := w.logger.Output(2, strings.TrimSuffix(string(p), "\n"))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// legacyLogger is a struct pairing a `log.Logger` instance with the `slog.Logger` instance that writes to it.
+type legacyLogger struct {
+	logger  *log.Logger
+	slogger *slog.Logger
+}
+
+// logger returns the `slog.Logger` instance used to log messages. If the indexer's `StructuredLogger` field is nil
+// messages at or above the info level are written, as key=value pairs, to the (legacy) `Logger` field instead.
+func (idx *SQLiteIndexer) logger() *slog.Logger {
+
+	if idx.StructuredLogger != nil {
+		return idx.StructuredLogger
+	}
+
+	// Cache the shim so it isn't recreated for every message but do so in a way that
+	// still honours changes to the Logger field after the indexer has been created
+
+	legacy := idx.legacy_logger.Load()
+
+	if legacy != nil && legacy.logger == idx.Logger {
+		return legacy.slogger
+	}
+
+	logger := idx.Logger
+
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	opts := &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+
+			// log.Logger instances add their own timestamps
+
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+
+			return a
+		},
+	}
+
+	h := slog.NewTextHandler(&legacyWriter{logger: logger}, opts)
+
+	legacy = &legacyLogger{
+		logger:  idx.Logger,
+		slogger: slog.New(h),
+	}
+
+	idx.legacy_logger.Store(legacy)
+	return legacy.slogger
+}
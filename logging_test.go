@@ -0,0 +1,75 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/aaronland/go-sqlite/v2"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestStructuredLogging(t *testing.T) {
+
+	f := newTestFixture(t, "logging.db")
+
+	uri := f.path("cmd")
+
+	var buf bytes.Buffer
+
+	logger, err := NewStructuredLogger(&buf, LOG_FORMAT_JSON, slog.LevelDebug)
+
+	if err != nil {
+		t.Fatalf("Failed to create logger, %v", err)
+	}
+
+	idx := f.indexer(t, &SQLiteIndexerOptions{
+		Tables:           []sqlite.Table{&FailingTable{}},
+		TablePolicies:    map[string]*TablePolicy{"names": &TablePolicy{Policy: TABLE_POLICY_BEST_EFFORT}},
+		StructuredLogger: logger,
+	})
+
+	err = idx.IndexURIs(f.ctx, "directory://", uri)
+
+	if err != nil {
+		t.Fatalf("Failed to index records, %v", err)
+	}
+
+	var msg map[string]interface{}
+
+	err = json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &msg)
+
+	if err != nil {
+		t.Fatalf("Failed to decode log message, %v", err)
+	}
+
+	if msg["level"] != "ERROR" || msg["table"] != "names" || msg["run_id"] == nil || msg["path"] == nil {
+		t.Fatalf("Unexpected log message %v", msg)
+	}
+
+	// Legacy log.Logger instances are still honoured when StructuredLogger is nil
+
+	buf.Reset()
+
+	idx.StructuredLogger = nil
+	idx.Logger = log.New(&buf, "", 0)
+
+	err = idx.IndexURIs(f.ctx, "directory://", uri)
+
+	if err != nil {
+		t.Fatalf("Failed to index records, %v", err)
+	}
+
+	first := strings.SplitN(buf.String(), "\n", 2)[0]
+
+	if !strings.HasPrefix(first, "level=ERROR msg=\"Failed to index record\" run_id=") || !strings.Contains(first, "table=names") {
+		t.Fatalf("Unexpected log message '%s'", first)
+	}
+
+	_, err = NewStructuredLogger(&buf, "xml", slog.LevelInfo)
+
+	if err == nil {
+		t.Fatalf("Expected invalid log format to fail")
+	}
+}
@@ -0,0 +1,251 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"time"
+)
+
+// SCHEMA_VERSIONS_TABLE is the name of the table used to record the schema version of each `VersionedTable` in a database.
+const SCHEMA_VERSIONS_TABLE string = "_schema_versions"
+
+// MigrationFunc is a custom function to migrate a table from the previous schema version to the version of the `Migration` it belongs to.
+// It is passed the transaction in which the new schema version will be recorded so that the migration and the version are committed together.
+type MigrationFunc func(context.Context, *sql.Tx) error
+
+// Migration is a struct describing how to migrate a table to a specific schema version.
+type Migration struct {
+	// Version is the schema version the table will be at once the migration has been applied.
+	Version int
+	// Migrate is the function that performs the migration.
+	Migrate MigrationFunc
+}
+
+// VersionedTable is an optional interface for `aaronland/go-sqlite.Table` implementations whose schema changes
+// over time. Before indexing, the indexer compares the version recorded in the `_schema_versions` table with the
+// value of `SchemaVersion` and applies any pending migrations (or refuses to continue). Tables with no recorded
+// version that do not exist yet, or are empty, are assumed to have been created using the current value of `Schema`
+// and are recorded as such. Tables with no recorded version that already contain rows must be assigned a baseline
+// version using the `SchemaBaselines` option.
+type VersionedTable interface {
+	sqlite.Table
+	// SchemaVersion returns the version of the table's current schema.
+	SchemaVersion() int
+	// Migrations returns the list of migrations needed to bring an older version of the table up to date, in order.
+	Migrations() []*Migration
+}
+
+// migrateTables ensures that each of 'tables' that implements the `VersionedTable` interface is at its current schema
+// version in 'db', applying pending migrations if the indexer has been configured to do so.
+func (idx *SQLiteIndexer) migrateTables(ctx context.Context, run *indexRun, db sqlite.Database, tables []sqlite.Table) error {
+
+	versioned := make([]VersionedTable, 0)
+
+	for _, t := range tables {
+
+		vt, ok := t.(VersionedTable)
+
+		if ok {
+			versioned = append(versioned, vt)
+		}
+	}
+
+	if len(versioned) == 0 {
+		return nil
+	}
+
+	db.Lock(ctx)
+	defer db.Unlock(ctx)
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		name TEXT NOT NULL PRIMARY KEY,
+		version INTEGER NOT NULL,
+		lastmodified INTEGER NOT NULL
+	)`, SCHEMA_VERSIONS_TABLE)
+
+	_, err = conn.ExecContext(ctx, q)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create %s table, %w", SCHEMA_VERSIONS_TABLE, err)
+	}
+
+	for _, t := range versioned {
+
+		err := idx.migrateTable(ctx, run, conn, t)
+
+		if err != nil {
+			return fmt.Errorf("Failed to migrate '%s' table, %w", t.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// migrateTable brings 't' up to its current schema version.
+func (idx *SQLiteIndexer) migrateTable(ctx context.Context, run *indexRun, conn *sql.DB, t VersionedTable) error {
+
+	current := t.SchemaVersion()
+
+	var recorded int
+
+	q := fmt.Sprintf("SELECT version FROM %s WHERE name = ?", SCHEMA_VERSIONS_TABLE)
+	err := conn.QueryRowContext(ctx, q, t.Name()).Scan(&recorded)
+
+	switch {
+	case err == sql.ErrNoRows:
+
+		baseline, err := idx.schemaBaseline(ctx, conn, t)
+
+		if err != nil {
+			return err
+		}
+
+		err = setSchemaVersion(ctx, conn, t.Name(), baseline)
+
+		if err != nil {
+			return err
+		}
+
+		recorded = baseline
+
+	case err != nil:
+		return fmt.Errorf("Failed to read schema version, %w", err)
+	}
+
+	if recorded == current {
+		return nil
+	}
+
+	if recorded > current {
+		return fmt.Errorf("Database schema version (%d) is newer than the table's schema version (%d)", recorded, current)
+	}
+
+	if !idx.migrate_schemas {
+		return fmt.Errorf("Database schema version (%d) is older than the table's schema version (%d) and migrations are disabled", recorded, current)
+	}
+
+	migrations := make(map[int]*Migration)
+
+	for _, m := range t.Migrations() {
+		migrations[m.Version] = m
+	}
+
+	for v := recorded + 1; v <= current; v++ {
+
+		m, ok := migrations[v]
+
+		if !ok {
+			return fmt.Errorf("Missing migration to schema version %d", v)
+		}
+
+		err := idx.applyMigration(ctx, run, conn, t, m)
+
+		if err != nil {
+			return fmt.Errorf("Failed to migrate to schema version %d, %w", v, err)
+		}
+
+		run.logger.Info("Migrated table", "table", t.Name(), "version", v)
+	}
+
+	return nil
+}
+
+// schemaBaseline returns the schema version to record for 't' when no version has been recorded yet. Tables that do
+// not exist, or are empty, are assumed to be at their current schema version. Otherwise the version defined in the
+// indexer's schema baselines is returned or, if there isn't one, an error since there is no way to know which of the
+// table's migrations have already been applied.
+func (idx *SQLiteIndexer) schemaBaseline(ctx context.Context, conn *sql.DB, t VersionedTable) (int, error) {
+
+	baseline, ok := idx.schema_baselines[t.Name()]
+
+	if ok {
+		return baseline, nil
+	}
+
+	var exists bool
+
+	err := conn.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", t.Name()).Scan(&exists)
+
+	if err != nil {
+		return 0, fmt.Errorf("Failed to determine whether table exists, %w", err)
+	}
+
+	if !exists {
+		return t.SchemaVersion(), nil
+	}
+
+	var populated bool
+
+	err = conn.QueryRowContext(ctx, fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s)", t.Name())).Scan(&populated)
+
+	if err != nil {
+		return 0, fmt.Errorf("Failed to determine whether table is empty, %w", err)
+	}
+
+	if populated {
+		return 0, fmt.Errorf("Table has no recorded schema version and is not empty; a baseline schema version must be defined")
+	}
+
+	return t.SchemaVersion(), nil
+}
+
+// applyMigration applies 'm' to 't' and records its version in a single transaction.
+func (idx *SQLiteIndexer) applyMigration(ctx context.Context, run *indexRun, conn *sql.DB, t VersionedTable, m *Migration) error {
+
+	tx, err := conn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return fmt.Errorf("Failed to start transaction, %w", err)
+	}
+
+	err = idx.safeCall(ctx, run, nil, t.Name(), func(ctx context.Context) error {
+		return m.Migrate(ctx, tx)
+	})
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = setSchemaVersion(ctx, tx, t.Name(), m.Version)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return fmt.Errorf("Failed to commit transaction, %w", err)
+	}
+
+	return nil
+}
+
+// execContext is the subset of methods shared by `sql.DB` and `sql.Tx` needed to record a schema version.
+type execContext interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}
+
+// setSchemaVersion records 'version' as the schema version for the table named 'name'.
+func setSchemaVersion(ctx context.Context, conn execContext, name string, version int) error {
+
+	q := fmt.Sprintf("INSERT OR REPLACE INTO %s (name, version, lastmodified) VALUES (?, ?, ?)", SCHEMA_VERSIONS_TABLE)
+
+	_, err := conn.ExecContext(ctx, q, name, version, time.Now().Unix())
+
+	if err != nil {
+		return fmt.Errorf("Failed to record schema version %d, %w", version, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"github.com/aaronland/go-sqlite/v2"
+	"testing"
+)
+
+type VersionedExampleTable struct {
+	sqlite.Table
+	version int
+}
+
+func (t *VersionedExampleTable) SchemaVersion() int {
+	return t.version
+}
+
+func (t *VersionedExampleTable) Migrations() []*Migration {
+
+	add_column := func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "ALTER TABLE example ADD COLUMN lastmodified INTEGER")
+		return err
+	}
+
+	return []*Migration{
+		&Migration{Version: 2, Migrate: add_column},
+	}
+}
+
+func TestMigrateTables(t *testing.T) {
+
+	f := newTestFixture(t, "migrations.db")
+
+	build := func(version int, migrate bool) error {
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			Tables:         []sqlite.Table{&VersionedExampleTable{f.example, version}},
+			MigrateSchemas: migrate,
+		})
+
+		return idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+	}
+
+	err := build(1, false)
+
+	if err != nil {
+		t.Fatalf("Failed to index version 1, %v", err)
+	}
+
+	err = build(2, false)
+
+	if err == nil {
+		t.Fatalf("Expected pending migration to fail when migrations are disabled")
+	}
+
+	err = build(2, true)
+
+	if err != nil {
+		t.Fatalf("Failed to migrate to version 2, %v", err)
+	}
+
+	err = build(1, true)
+
+	if err == nil {
+		t.Fatalf("Expected older table schema version to fail")
+	}
+
+	err = build(3, true)
+
+	if err == nil {
+		t.Fatalf("Expected missing migration to fail")
+	}
+}
+
+func TestMigrateUnversionedTable(t *testing.T) {
+
+	f := newTestFixture(t, "unversioned.db")
+
+	// Index records before the table is versioned
+
+	err := f.indexer(t, &SQLiteIndexerOptions{}).IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	if err != nil {
+		t.Fatalf("Failed to index unversioned table, %v", err)
+	}
+
+	build := func(baselines map[string]int) error {
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			Tables:          []sqlite.Table{&VersionedExampleTable{f.example, 2}},
+			MigrateSchemas:  true,
+			SchemaBaselines: baselines,
+		})
+
+		return idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+	}
+
+	err = build(nil)
+
+	if err == nil {
+		t.Fatalf("Expected existing table without a baseline schema version to fail")
+	}
+
+	if f.count(t, f.db, "SELECT COUNT(*) FROM _schema_versions") != 0 {
+		t.Fatalf("Expected no schema version to be recorded for existing table")
+	}
+
+	err = build(map[string]int{"example": 1})
+
+	if err != nil {
+		t.Fatalf("Failed to migrate from baseline schema version, %v", err)
+	}
+
+	if f.count(t, f.db, "SELECT version FROM _schema_versions WHERE name = ?", "example") != 2 {
+		t.Fatalf("Expected schema version 2 to be recorded")
+	}
+
+	if f.count(t, f.db, "SELECT COUNT(*) FROM pragma_table_info('example') WHERE name = 'lastmodified'") != 1 {
+		t.Fatalf("Expected migration to add lastmodified column")
+	}
+
+	_, err = NewSQLiteIndexer(&SQLiteIndexerOptions{
+		Tables:          []sqlite.Table{f.example},
+		SchemaBaselines: map[string]int{"search": 1},
+	})
+
+	if err == nil {
+		t.Fatalf("Expected schema baseline for unknown table to fail")
+	}
+}
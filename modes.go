@@ -0,0 +1,114 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+)
+
+// TABLE_MODE_APPEND is a flag to signal that records should be indexed in to a table as-is, alongside any existing rows. This is the default.
+const TABLE_MODE_APPEND string = "append"
+
+// TABLE_MODE_TRUNCATE is a flag to signal that all the rows in a table should be deleted before indexing.
+const TABLE_MODE_TRUNCATE string = "truncate"
+
+// TABLE_MODE_RECREATE is a flag to signal that a table should be dropped and recreated (using its current schema) before indexing.
+const TABLE_MODE_RECREATE string = "recreate"
+
+// isValidTableMode returns a boolean value indicating whether 'mode' is a known table mode.
+func isValidTableMode(mode string) bool {
+
+	switch mode {
+	case TABLE_MODE_APPEND, TABLE_MODE_TRUNCATE, TABLE_MODE_RECREATE:
+		return true
+	default:
+		return false
+	}
+}
+
+// prepareTables truncates or recreates each of 'tables' in 'db' according to its table mode.
+func (idx *SQLiteIndexer) prepareTables(ctx context.Context, db sqlite.Database, tables []sqlite.Table) error {
+
+	if len(idx.table_modes) == 0 {
+		return nil
+	}
+
+	db.Lock(ctx)
+	defer db.Unlock(ctx)
+
+	for _, t := range tables {
+
+		mode, ok := idx.table_modes[t.Name()]
+
+		if !ok || mode == TABLE_MODE_APPEND {
+			continue
+		}
+
+		err := idx.prepareTable(ctx, db, t, mode)
+
+		if err != nil {
+			return fmt.Errorf("Failed to %s '%s' table, %w", mode, t.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// prepareTable truncates or recreates 't' in 'db' according to 'mode'.
+func (idx *SQLiteIndexer) prepareTable(ctx context.Context, db sqlite.Database, t sqlite.Table, mode string) error {
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	switch mode {
+	case TABLE_MODE_TRUNCATE:
+
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s", t.Name()))
+
+		if err != nil {
+			return fmt.Errorf("Failed to delete rows, %w", err)
+		}
+
+	case TABLE_MODE_RECREATE:
+
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", t.Name()))
+
+		if err != nil {
+			return fmt.Errorf("Failed to drop table, %w", err)
+		}
+
+		err = t.InitializeTable(ctx, db)
+
+		if err != nil {
+			return fmt.Errorf("Failed to initialize table, %w", err)
+		}
+
+		// A recreated table is, by definition, at its current schema version so
+		// forget anything that was recorded for its previous incarnation
+
+		has_versions, err := sqlite.HasTableWithSQLDB(ctx, conn, SCHEMA_VERSIONS_TABLE)
+
+		if err != nil {
+			return fmt.Errorf("Failed to determine whether %s table exists, %w", SCHEMA_VERSIONS_TABLE, err)
+		}
+
+		if has_versions {
+
+			q := fmt.Sprintf("DELETE FROM %s WHERE name = ?", SCHEMA_VERSIONS_TABLE)
+			_, err = conn.ExecContext(ctx, q, t.Name())
+
+			if err != nil {
+				return fmt.Errorf("Failed to remove schema version, %w", err)
+			}
+		}
+
+	default:
+		return fmt.Errorf("Invalid table mode '%s'", mode)
+	}
+
+	idx.logger().Info("Prepared table", "table", t.Name(), "mode", mode)
+	return nil
+}
@@ -0,0 +1,60 @@
+package index
+
+import (
+	"github.com/aaronland/go-sqlite/v2"
+	"testing"
+)
+
+func TestTableModes(t *testing.T) {
+
+	f := newTestFixture(t, "modes.db")
+
+	build := func(mode string) int {
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			TableModes: map[string]string{
+				f.example.Name(): mode,
+			},
+		})
+
+		err := idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+		if err != nil {
+			t.Fatalf("Failed to index URIs in '%s' mode, %v", mode, err)
+		}
+
+		return f.count(t, f.db, "SELECT COUNT(*) FROM example")
+	}
+
+	count := build(TABLE_MODE_APPEND)
+
+	if build(TABLE_MODE_APPEND) != count*2 {
+		t.Fatalf("Expected '%s' mode to keep existing rows", TABLE_MODE_APPEND)
+	}
+
+	if build(TABLE_MODE_TRUNCATE) != count {
+		t.Fatalf("Expected '%s' mode to delete existing rows", TABLE_MODE_TRUNCATE)
+	}
+
+	if build(TABLE_MODE_RECREATE) != count {
+		t.Fatalf("Expected '%s' mode to delete existing rows", TABLE_MODE_RECREATE)
+	}
+
+	_, err := NewSQLiteIndexer(&SQLiteIndexerOptions{
+		Tables:     []sqlite.Table{f.example},
+		TableModes: map[string]string{"example": "upsert"},
+	})
+
+	if err == nil {
+		t.Fatalf("Expected invalid table mode to fail")
+	}
+
+	_, err = NewSQLiteIndexer(&SQLiteIndexerOptions{
+		Tables:     []sqlite.Table{f.example},
+		TableModes: map[string]string{"search": TABLE_MODE_TRUNCATE},
+	})
+
+	if err == nil {
+		t.Fatalf("Expected table mode for unknown table to fail")
+	}
+}
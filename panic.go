@@ -0,0 +1,167 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"runtime/debug"
+	"time"
+)
+
+// guarded_release_timeout is the maximum amount of time `withGuardedDatabase` waits, after a panic, for the connections
+// used by transactions that were started with a (now cancelled) context to be returned to the pool.
+const guarded_release_timeout time.Duration = time.Second
+
+// PanicError is an error describing a panic that was recovered while loading, indexing or otherwise processing a record.
+type PanicError struct {
+	// Path is the path of the record being processed when the panic occurred. It may be empty if the panic did not occur
+	// while processing an individual record (for example during finalization).
+	Path string
+	// Key is the key of the record being processed when the panic occurred. It may be empty if the panic did not occur
+	// while processing an individual record or no key could be derived.
+	Key string
+	// Table is the name of the table being indexed when the panic occurred. It is empty if the panic did not occur inside a table.
+	Table string
+	// Value is the value passed to `panic`.
+	Value interface{}
+	// Stack is the stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+// Error returns a description of the panic, without its stack trace.
+func (e *PanicError) Error() string {
+
+	switch {
+	case e.Table != "" && e.Path != "":
+		return fmt.Sprintf("Recovered from panic in '%s' table while processing %s: %v", e.Table, describeRecord(e.Key, e.Path), e.Value)
+	case e.Table != "":
+		return fmt.Sprintf("Recovered from panic in '%s' table: %v", e.Table, e.Value)
+	case e.Path != "":
+		return fmt.Sprintf("Recovered from panic while processing %s: %v", describeRecord(e.Key, e.Path), e.Value)
+	default:
+		return fmt.Sprintf("Recovered from panic: %v", e.Value)
+	}
+}
+
+// safeCall invokes 'fn' converting any panic in to a `PanicError` for 'lr' and 'table', either of which may be empty, and
+// logging it using the logger for 'run' (or the indexer's logger if 'run' is nil). 'fn' is passed a context derived from
+// 'ctx' that is cancelled as soon as 'fn' returns (or panics) so that any transactions started with that context, using
+// `sql.DB.BeginTx`, that are still open are rolled back by the `database/sql` package. Transactions started by executing
+// "BEGIN" are rolled back if 'fn' accesses the database using `withGuardedDatabase`. Locks held by the caller are unaffected
+// since the panic does not propagate past this function.
+func (idx *SQLiteIndexer) safeCall(ctx context.Context, run *indexRun, lr *loadedRecord, table string, fn func(context.Context) error) (err error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer func() {
+
+		r := recover()
+
+		if r == nil {
+			return
+		}
+
+		panic_err := &PanicError{
+			Table: table,
+			Value: r,
+			Stack: debug.Stack(),
+		}
+
+		if lr != nil {
+
+			panic_err.Path = lr.path
+			panic_err.Key = lr.key
+
+			// The record is nil if it was being loaded when the panic occurred
+
+			if panic_err.Key == "" && lr.record != nil {
+				panic_err.Key = idx.recordKey(lr)
+			}
+		}
+
+		logger := idx.logger()
+
+		if run != nil {
+			logger = run.logger
+		}
+
+		logger.Error("Recovered from panic", "path", panic_err.Path, "key", panic_err.Key, "table", table, "panic", r, "stack", string(panic_err.Stack))
+		err = panic_err
+	}()
+
+	return fn(ctx)
+}
+
+// withGuardedDatabase invokes 'fn' with a context derived from 'ctx' and, if 'fn' panics, rolls back the transactions it
+// left open in 'db' before the panic is propagated so that they do not block subsequent writes to 'db'. Transactions started
+// with that context (for example using `sql.DB.BeginTx`) are rolled back by cancelling it and, once their connections have
+// been returned to the pool, transactions started by executing "BEGIN" that were left open on idle connections are rolled
+// back explicitly. Transactions started without a context (for example using `sql.DB.Begin`), or on connections reserved
+// using `sql.DB.Conn` that were not closed, can not be rolled back. Nothing is done unless 'fn' panics.
+func withGuardedDatabase(ctx context.Context, db sqlite.Database, fn func(context.Context) error) error {
+
+	pool, err := db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	in_use := pool.Stats().InUse
+
+	fn_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer func() {
+
+		r := recover()
+
+		if r == nil {
+			return
+		}
+
+		cancel()
+		rollbackIdleTransactions(ctx, pool, in_use)
+
+		panic(r)
+	}()
+
+	return fn(fn_ctx)
+}
+
+// rollbackIdleTransactions waits, for up to `guarded_release_timeout`, until no more than 'in_use' of the connections
+// in 'pool' are in use and then executes "ROLLBACK" on each of its idle connections, ignoring the errors returned by
+// connections without an open transaction.
+func rollbackIdleTransactions(ctx context.Context, pool *sql.DB, in_use int) {
+
+	t1 := time.Now()
+
+	for pool.Stats().InUse > in_use && time.Since(t1) < guarded_release_timeout {
+		time.Sleep(time.Millisecond)
+	}
+
+	idle := pool.Stats().Idle
+	conns := make([]*sql.Conn, 0, idle)
+
+	defer func() {
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	// Connections are reserved until they have all been rolled back so that each one is only visited once
+
+	for i := 0; i < idle; i++ {
+
+		conn, err := pool.Conn(ctx)
+
+		if err != nil {
+			return
+		}
+
+		conns = append(conns, conn)
+		conn.ExecContext(ctx, "ROLLBACK")
+	}
+}
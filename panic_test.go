@@ -0,0 +1,194 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aaronland/go-sqlite/v2"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+type PanickingTable struct {
+	FailingTable
+}
+
+func (t *PanickingTable) IndexRecord(ctx context.Context, db sqlite.Database, record interface{}) error {
+	panic("Invalid encoding")
+}
+
+type TransactionPanickingTable struct {
+	FailingTable
+	// exec signals that the transaction should be started by executing "BEGIN" rather than using `sql.DB.BeginTx`.
+	exec bool
+}
+
+func (t *TransactionPanickingTable) IndexRecord(ctx context.Context, db sqlite.Database, record interface{}) error {
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if t.exec {
+
+		_, err = conn.ExecContext(ctx, "BEGIN; INSERT INTO example (id, body) VALUES (-2, 'uncommitted')")
+
+		if err != nil {
+			return err
+		}
+
+		panic("Invalid encoding")
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO example (id, body) VALUES (-2, 'uncommitted')")
+
+	if err != nil {
+		return err
+	}
+
+	panic("Invalid encoding")
+}
+
+func TestPanicIsolation(t *testing.T) {
+
+	f := newTestFixture(t, "panic.db")
+
+	build := func(record_func SQLiteIndexerLoadRecordFunc, policy *TablePolicy) (*SQLiteIndexer, error) {
+
+		idx_opts := &SQLiteIndexerOptions{
+			Tables:         []sqlite.Table{f.example, &PanickingTable{}},
+			LoadRecordFunc: record_func,
+		}
+
+		if policy != nil {
+			idx_opts.TablePolicies = map[string]*TablePolicy{
+				"names": policy,
+			}
+		}
+
+		idx := f.indexer(t, idx_opts)
+		return idx, idx.IndexURIs(f.ctx, "directory://", f.path("cmd"))
+	}
+
+	_, err := build(nil, nil)
+
+	var panic_err *PanicError
+
+	if !errors.As(err, &panic_err) {
+		t.Fatalf("Expected required table to return a PanicError, got %v", err)
+	}
+
+	if panic_err.Table != "names" || panic_err.Path == "" || len(panic_err.Stack) == 0 {
+		t.Fatalf("Unexpected PanicError %#v", panic_err)
+	}
+
+	if panic_err.Key != "" {
+		t.Fatalf("Expected PanicError for a record without a key to have an empty key, got '%s'", panic_err.Key)
+	}
+
+	idx, err := build(nil, &TablePolicy{Policy: TABLE_POLICY_BEST_EFFORT})
+
+	if err != nil {
+		t.Fatalf("Expected best-effort table not to fail, %v", err)
+	}
+
+	if idx.TableFailures()["names"] == 0 {
+		t.Fatalf("Expected panics to be counted as table failures")
+	}
+
+	panicking_func := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+		var m map[string]string
+		m[path] = path
+		return m, nil
+	}
+
+	_, err = build(panicking_func, &TablePolicy{Policy: TABLE_POLICY_BEST_EFFORT})
+
+	if !errors.As(err, &panic_err) {
+		t.Fatalf("Expected loader to return a PanicError, got %v", err)
+	}
+
+	if panic_err.Table != "" || panic_err.Path == "" {
+		t.Fatalf("Unexpected PanicError %#v", panic_err)
+	}
+}
+
+func TestPanicRollback(t *testing.T) {
+
+	f := newTestFixture(t, "rollback.db")
+
+	var buf bytes.Buffer
+
+	logger, err := NewStructuredLogger(&buf, LOG_FORMAT_JSON, slog.LevelError)
+
+	if err != nil {
+		t.Fatalf("Failed to create logger, %v", err)
+	}
+
+	build := func(tb sqlite.Table, policy string) (*SQLiteIndexer, error) {
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			Tables:           []sqlite.Table{tb, f.example},
+			LoadRecordFunc:   pathRecord,
+			KeyFunc:          pathKey,
+			TablePolicies:    map[string]*TablePolicy{"names": &TablePolicy{Policy: policy}},
+			TableModes:       map[string]string{"example": TABLE_MODE_TRUNCATE},
+			StructuredLogger: logger,
+			ProgressFunc: func(ctx context.Context, p *Progress) {
+				panic("Invalid progress")
+			},
+		})
+
+		return idx, idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+	}
+
+	_, err = build(&TransactionPanickingTable{}, TABLE_POLICY_REQUIRED)
+
+	var panic_err *PanicError
+
+	if !errors.As(err, &panic_err) || panic_err.Key != panic_err.Path {
+		t.Fatalf("Expected PanicError with the record's key, got %v", err)
+	}
+
+	// Transactions started using conn.BeginTx, or by executing BEGIN, must be rolled back or they
+	// would prevent the example table from being written to
+
+	for _, tb := range []*TransactionPanickingTable{&TransactionPanickingTable{}, &TransactionPanickingTable{exec: true}} {
+
+		idx, err := build(tb, TABLE_POLICY_BEST_EFFORT)
+
+		if err != nil {
+			t.Fatalf("Expected best-effort table not to fail (exec %t), %v", tb.exec, err)
+		}
+
+		if f.count(t, f.db, "SELECT COUNT(*) FROM example WHERE id = -2") != 0 {
+			t.Fatalf("Expected uncommitted row to be rolled back (exec %t)", tb.exec)
+		}
+
+		if f.count(t, f.db, "SELECT COUNT(*) FROM example") != int(idx.Stats().Indexed) {
+			t.Fatalf("Expected every record to be indexed in example table (exec %t)", tb.exec)
+		}
+	}
+
+	var msg map[string]interface{}
+
+	err = json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &msg)
+
+	if err != nil {
+		t.Fatalf("Failed to decode log message, %v", err)
+	}
+
+	if msg["msg"] != "Recovered from panic" || msg["run_id"] == nil || msg["key"] == "" {
+		t.Fatalf("Unexpected log message %v", msg)
+	}
+}
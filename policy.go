@@ -0,0 +1,160 @@
+package index
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TABLE_POLICY_REQUIRED is a flag to signal that a failure to index a record in a table should stop the run. This is the default.
+const TABLE_POLICY_REQUIRED string = "required"
+
+// TABLE_POLICY_BEST_EFFORT is a flag to signal that failures to index a record in a table should be logged, counted and otherwise ignored.
+const TABLE_POLICY_BEST_EFFORT string = "best-effort"
+
+// TABLE_POLICY_DISABLE_AFTER is a flag to signal that failures to index a record in a table should be logged and counted
+// until `TablePolicy.MaxFailures` is reached, after which the table is disabled for the remainder of the run.
+const TABLE_POLICY_DISABLE_AFTER string = "disable-after"
+
+// TablePolicy is a struct describing how failures to index records in a table should be handled.
+type TablePolicy struct {
+	// Policy is the name of the policy. Valid options are: TABLE_POLICY_REQUIRED, TABLE_POLICY_BEST_EFFORT, TABLE_POLICY_DISABLE_AFTER.
+	Policy string
+	// MaxFailures is the number of failures after which a table is disabled when `Policy` is TABLE_POLICY_DISABLE_AFTER.
+	MaxFailures int64
+}
+
+// validate returns an error if 'p' is not a valid table policy.
+func (p *TablePolicy) validate() error {
+
+	switch p.Policy {
+	case TABLE_POLICY_REQUIRED, TABLE_POLICY_BEST_EFFORT:
+		return nil
+	case TABLE_POLICY_DISABLE_AFTER:
+
+		if p.MaxFailures < 1 {
+			return fmt.Errorf("'%s' policy requires MaxFailures to be greater than zero", p.Policy)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("Invalid table policy '%s'", p.Policy)
+	}
+}
+
+// tableFailures is a struct used to count failures, and track disabled tables, during a run.
+type tableFailures struct {
+	mu       *sync.Mutex
+	counts   map[string]int64
+	disabled map[string]bool
+}
+
+// newTableFailures returns a new (empty) `tableFailures` instance.
+func newTableFailures() *tableFailures {
+
+	f := &tableFailures{
+		mu:       new(sync.Mutex),
+		counts:   make(map[string]int64),
+		disabled: make(map[string]bool),
+	}
+
+	return f
+}
+
+// Add increments the failure count for the table named 'name' and disables it if 'policy' says it should be,
+// returning the new failure count and whether the table was disabled.
+func (f *tableFailures) Add(name string, policy *TablePolicy) (int64, bool) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.counts[name] += 1
+	count := f.counts[name]
+
+	if policy.Policy == TABLE_POLICY_DISABLE_AFTER && count >= policy.MaxFailures && !f.disabled[name] {
+		f.disabled[name] = true
+		return count, true
+	}
+
+	return count, false
+}
+
+// IsDisabled returns a boolean value indicating whether the table named 'name' has been disabled.
+func (f *tableFailures) IsDisabled(name string) bool {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.disabled[name]
+}
+
+// Counts returns a copy of the failure counts for each table that has failed at least once.
+func (f *tableFailures) Counts() map[string]int64 {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	counts := make(map[string]int64)
+
+	for name, count := range f.counts {
+		counts[name] = count
+	}
+
+	return counts
+}
+
+// tablePolicy returns the `TablePolicy` for the table named 'name', defaulting to TABLE_POLICY_REQUIRED.
+func (idx *SQLiteIndexer) tablePolicy(name string) *TablePolicy {
+
+	p, ok := idx.table_policies[name]
+
+	if !ok || p == nil {
+		return &TablePolicy{Policy: TABLE_POLICY_REQUIRED}
+	}
+
+	return p
+}
+
+// tableFailed applies the policy for the table named 'table' to 'err', a failure to route or index 'lr' in that table
+// during 'run'. If the table is required a `TableIndexError` is returned. Otherwise the failure is counted, and logged,
+// the table is disabled if necessary and nil is returned.
+func (idx *SQLiteIndexer) tableFailed(run *indexRun, lr *loadedRecord, table string, err error) error {
+
+	policy := idx.tablePolicy(table)
+
+	if policy.Policy == TABLE_POLICY_REQUIRED {
+		run.logger.Error("Failed to index record", "path", lr.path, "key", idx.recordKey(lr), "table", table, "error", err)
+		return &TableIndexError{Path: lr.path, Key: idx.recordKey(lr), Table: table, Err: err}
+	}
+
+	count, disabled := run.failures.Add(table, policy)
+
+	run.logger.Error("Failed to index record", "path", lr.path, "key", idx.recordKey(lr), "table", table, "failures", count, "error", err)
+
+	if disabled {
+		run.logger.Warn("Disabling table for the remainder of the run", "table", table, "failures", count)
+	}
+
+	return nil
+}
+
+// reportTableFailures stores the per-table failure counts for 'run' so they can be retrieved by the `TableFailures` method
+// and logs a summary of them.
+func (idx *SQLiteIndexer) reportTableFailures(run *indexRun) {
+
+	counts := run.failures.Counts()
+
+	idx.mu.Lock()
+	idx.table_failures = counts
+	idx.mu.Unlock()
+
+	for name, count := range counts {
+
+		status := "enabled"
+
+		if run.failures.IsDisabled(name) {
+			status = "disabled"
+		}
+
+		run.logger.Warn("Failed to index records in table", "table", name, "failures", count, "status", status)
+	}
+}
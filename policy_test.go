@@ -0,0 +1,167 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"testing"
+)
+
+type FailingTable struct {
+	sqlite.Table
+}
+
+func (t *FailingTable) Name() string {
+	return "names"
+}
+
+func (t *FailingTable) Schema() string {
+	return ""
+}
+
+func (t *FailingTable) InitializeTable(ctx context.Context, db sqlite.Database) error {
+	return nil
+}
+
+func (t *FailingTable) IndexRecord(ctx context.Context, db sqlite.Database, record interface{}) error {
+	return fmt.Errorf("Invalid encoding")
+}
+
+func TestTablePolicies(t *testing.T) {
+
+	f := newTestFixture(t, "policy.db")
+
+	build := func(policy *TablePolicy) (map[string]int64, error) {
+
+		idx_opts := &SQLiteIndexerOptions{
+			Tables: []sqlite.Table{f.example, &FailingTable{}},
+		}
+
+		if policy != nil {
+			idx_opts.TablePolicies = map[string]*TablePolicy{
+				"names": policy,
+			}
+		}
+
+		idx := f.indexer(t, idx_opts)
+
+		err := idx.IndexURIs(f.ctx, "directory://", f.path("cmd"), f.path("config"))
+		return idx.TableFailures(), err
+	}
+
+	_, err := build(nil)
+
+	if err == nil {
+		t.Fatalf("Expected required table to fail")
+	}
+
+	failures, err := build(&TablePolicy{Policy: TABLE_POLICY_BEST_EFFORT})
+
+	if err != nil {
+		t.Fatalf("Expected best-effort table not to fail, %v", err)
+	}
+
+	if failures["names"] < 3 {
+		t.Fatalf("Expected a failure for every record, got %d", failures["names"])
+	}
+
+	failures, err = build(&TablePolicy{Policy: TABLE_POLICY_DISABLE_AFTER, MaxFailures: 2})
+
+	if err != nil {
+		t.Fatalf("Expected disable-after table not to fail, %v", err)
+	}
+
+	if failures["names"] != 2 {
+		t.Fatalf("Expected table to be disabled after 2 failures, got %d", failures["names"])
+	}
+
+	_, err = NewSQLiteIndexer(&SQLiteIndexerOptions{
+		Tables:        []sqlite.Table{&FailingTable{}},
+		TablePolicies: map[string]*TablePolicy{"names": &TablePolicy{Policy: TABLE_POLICY_DISABLE_AFTER}},
+	})
+
+	if err == nil {
+		t.Fatalf("Expected disable-after policy without MaxFailures to fail")
+	}
+}
+
+func TestTablePolicyFailures(t *testing.T) {
+
+	f := newTestFixture(t, "policy_failures.db")
+
+	best_effort := map[string]*TablePolicy{
+		"names": &TablePolicy{Policy: TABLE_POLICY_BEST_EFFORT},
+	}
+
+	// Records that fail in the only table they are indexed in are failed, not skipped
+
+	idx := f.indexer(t, &SQLiteIndexerOptions{
+		Tables:        []sqlite.Table{&FailingTable{}},
+		TablePolicies: best_effort,
+	})
+
+	err := idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	if err != nil {
+		t.Fatalf("Expected best-effort table not to fail, %v", err)
+	}
+
+	stats := idx.Stats()
+
+	if stats.Failed != stats.Seen || stats.Skipped != 0 {
+		t.Fatalf("Expected every record to be counted as failed, %v", stats)
+	}
+
+	// Routing errors are handled according to the table's policy
+
+	route_func := func(ctx context.Context, record interface{}) (bool, error) {
+		return false, fmt.Errorf("Invalid route")
+	}
+
+	idx_opts := &SQLiteIndexerOptions{
+		Tables: []sqlite.Table{f.example, &FailingTable{}},
+		TableRoutes: map[string]SQLiteIndexerRoutingFunc{
+			"names": route_func,
+		},
+		TablePolicies: best_effort,
+	}
+
+	idx = f.indexer(t, idx_opts)
+
+	err = idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	if err != nil {
+		t.Fatalf("Expected best-effort routing errors not to fail, %v", err)
+	}
+
+	stats = idx.Stats()
+
+	if stats.Failed != 0 || stats.Indexed != stats.Seen {
+		t.Fatalf("Expected records to be indexed in the example table, %v", stats)
+	}
+
+	if idx.TableFailures()["names"] != stats.Seen {
+		t.Fatalf("Expected a routing failure for every record, got %d", idx.TableFailures()["names"])
+	}
+
+	idx_opts.TablePolicies = nil
+	idx = f.indexer(t, idx_opts)
+
+	err = idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	var table_err *TableIndexError
+
+	if !errors.As(err, &table_err) || table_err.Table != "names" {
+		t.Fatalf("Expected routing error in required table to be a TableIndexError, %v", err)
+	}
+
+	_, err = NewSQLiteIndexer(&SQLiteIndexerOptions{
+		Tables:        []sqlite.Table{&FailingTable{}},
+		TablePolicies: map[string]*TablePolicy{"names": nil},
+	})
+
+	if err == nil {
+		t.Fatalf("Expected empty policy to fail")
+	}
+}
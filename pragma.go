@@ -0,0 +1,134 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// PRAGMA_PROFILE_BULK_LOAD is a flag to signal that the pragmas applied by `aaronland/go-sqlite.LiveHardDieFast` should be used
+// during indexing. These trade durability for speed and are reverted (journal, synchronous and locking modes) after the run.
+const PRAGMA_PROFILE_BULK_LOAD string = "bulk-load"
+
+// PRAGMA_PROFILE_WAL is a flag to signal that the database should use write-ahead logging during indexing so that other processes
+// can read from it concurrently. The journal mode is reverted, and the log checkpointed, after the run.
+const PRAGMA_PROFILE_WAL string = "wal"
+
+// PRAGMA_PROFILE_SAFE is a flag to signal that durable, conservative pragmas should be used during indexing. This is suitable for
+// incremental updates to a database that is already published. Nothing is reverted after the run.
+const PRAGMA_PROFILE_SAFE string = "safe"
+
+// pragma is a struct describing an individual pragma to set and whether its original value should be restored after a run.
+type pragma struct {
+	name   string
+	value  string
+	revert bool
+}
+
+// pragma_profiles is the lookup table of named pragma profiles.
+var pragma_profiles = map[string][]*pragma{
+	PRAGMA_PROFILE_BULK_LOAD: []*pragma{
+		&pragma{name: "JOURNAL_MODE", value: "OFF", revert: true},
+		&pragma{name: "SYNCHRONOUS", value: "OFF", revert: true},
+		&pragma{name: "LOCKING_MODE", value: "EXCLUSIVE", revert: true},
+		// https://www.gaia-gis.it/gaia-sins/spatialite-cookbook/html/system.html
+		&pragma{name: "PAGE_SIZE", value: "4096"},
+		&pragma{name: "CACHE_SIZE", value: "1000000"},
+	},
+	PRAGMA_PROFILE_WAL: []*pragma{
+		&pragma{name: "JOURNAL_MODE", value: "WAL", revert: true},
+		&pragma{name: "SYNCHRONOUS", value: "NORMAL", revert: true},
+	},
+	PRAGMA_PROFILE_SAFE: []*pragma{
+		&pragma{name: "JOURNAL_MODE", value: "DELETE"},
+		&pragma{name: "SYNCHRONOUS", value: "FULL"},
+		&pragma{name: "LOCKING_MODE", value: "NORMAL"},
+	},
+}
+
+// PragmaProfiles returns the sorted list of valid pragma profile names.
+func PragmaProfiles() []string {
+
+	profiles := make([]string, 0)
+
+	for name, _ := range pragma_profiles {
+		profiles = append(profiles, name)
+	}
+
+	sort.Strings(profiles)
+	return profiles
+}
+
+// applyPragmaProfile applies the pragmas defined by 'profile' to the indexer's database and returns a function
+// which restores the original values of any pragmas that should be reverted after the run.
+func (idx *SQLiteIndexer) applyPragmaProfile(ctx context.Context, profile string) (func(context.Context) error, error) {
+
+	pragmas, ok := pragma_profiles[profile]
+
+	if !ok {
+		return nil, fmt.Errorf("Invalid pragma profile '%s'", profile)
+	}
+
+	conn, err := idx.db.Conn(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	restore := make([]*pragma, 0)
+
+	for _, p := range pragmas {
+
+		if p.revert {
+
+			var value string
+
+			q := fmt.Sprintf("PRAGMA %s", p.name)
+			err := conn.QueryRowContext(ctx, q).Scan(&value)
+
+			if err != nil && err != sql.ErrNoRows {
+				return nil, fmt.Errorf("Failed to read pragma '%s', %w", p.name, err)
+			}
+
+			if value != "" {
+				restore = append(restore, &pragma{name: p.name, value: value})
+			}
+		}
+
+		q := fmt.Sprintf("PRAGMA %s=%s", p.name, p.value)
+		_, err := conn.ExecContext(ctx, q)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set pragma '%s', %w", q, err)
+		}
+	}
+
+	revert_func := func(ctx context.Context) error {
+
+		if profile == PRAGMA_PROFILE_WAL {
+
+			_, err := conn.ExecContext(ctx, "PRAGMA WAL_CHECKPOINT(TRUNCATE)")
+
+			if err != nil {
+				return fmt.Errorf("Failed to checkpoint write-ahead log, %w", err)
+			}
+		}
+
+		for i := len(restore) - 1; i >= 0; i-- {
+
+			p := restore[i]
+			q := fmt.Sprintf("PRAGMA %s=%s", p.name, p.value)
+
+			_, err := conn.ExecContext(ctx, q)
+
+			if err != nil {
+				return fmt.Errorf("Failed to restore pragma '%s', %w", q, err)
+			}
+		}
+
+		return nil
+	}
+
+	return revert_func, nil
+}
@@ -0,0 +1,60 @@
+package index
+
+import (
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/aaronland/go-sqlite/v2/tables"
+	"strings"
+	"testing"
+)
+
+func TestPragmaProfiles(t *testing.T) {
+
+	f := newTestFixture(t, "pragma.db")
+
+	for _, profile := range PragmaProfiles() {
+
+		db := f.openDatabase(t, profile+".db")
+
+		ex_t, err := tables.NewExampleTableWithDatabase(f.ctx, db)
+
+		if err != nil {
+			t.Fatalf("Failed to create example table, %v", err)
+		}
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			DB:            db,
+			Tables:        []sqlite.Table{ex_t},
+			PragmaProfile: profile,
+		})
+
+		err = idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+		if err != nil {
+			t.Fatalf("Failed to index URIs with '%s' profile, %v", profile, err)
+		}
+
+		conn, err := db.Conn(f.ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to establish database connection, %v", err)
+		}
+
+		var mode string
+
+		err = conn.QueryRowContext(f.ctx, "PRAGMA JOURNAL_MODE").Scan(&mode)
+
+		if err != nil {
+			t.Fatalf("Failed to read journal mode, %v", err)
+		}
+
+		if strings.ToLower(mode) != "delete" {
+			t.Fatalf("Expected journal mode to be 'delete' after '%s' profile, got '%s'", profile, mode)
+		}
+	}
+
+	_, err := NewSQLiteIndexer(&SQLiteIndexerOptions{PragmaProfile: "live-harder"})
+
+	if err == nil {
+		t.Fatalf("Expected invalid pragma profile to fail")
+	}
+}
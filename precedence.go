@@ -0,0 +1,135 @@
+package index
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PRECEDENCE_FIRST_SEEN is a flag to signal that the first record seen for a given key during a run is kept and any subsequent duplicates are discarded.
+const PRECEDENCE_FIRST_SEEN string = "first-seen"
+
+// PRECEDENCE_SOURCE_ORDER is a flag to signal that, for records with the same key, the record from the source listed first (passed to `IndexSources`) is kept.
+const PRECEDENCE_SOURCE_ORDER string = "source-order"
+
+// PRECEDENCE_LASTMODIFIED is a flag to signal that, for records with the same key, the record with the newest last modified time is kept.
+const PRECEDENCE_LASTMODIFIED string = "lastmodified"
+
+// Conflict is a struct describing two records with the same key encountered during a run and which of them was kept.
+type Conflict struct {
+	// Key is the key shared by both records.
+	Key string
+	// KeptPath is the path of the record that was kept.
+	KeptPath string
+	// KeptSource is the iterator URI of the source that produced the record that was kept.
+	KeptSource string
+	// DiscardedPath is the path of the record that was discarded.
+	DiscardedPath string
+	// DiscardedSource is the iterator URI of the source that produced the record that was discarded.
+	DiscardedSource string
+}
+
+// String returns a human-readable description of the conflict.
+func (c *Conflict) String() string {
+	return fmt.Sprintf("%s: kept %s (%s), discarded %s (%s)", c.Key, c.KeptPath, c.KeptSource, c.DiscardedPath, c.DiscardedSource)
+}
+
+// isValidPrecedence returns a boolean value indicating whether 'policy' is a known precedence policy.
+func isValidPrecedence(policy string) bool {
+
+	switch policy {
+	case PRECEDENCE_FIRST_SEEN, PRECEDENCE_SOURCE_ORDER, PRECEDENCE_LASTMODIFIED:
+		return true
+	default:
+		return false
+	}
+}
+
+// recordClaim is a struct describing the record currently associated with a given key during a run.
+type recordClaim struct {
+	path          string
+	source        int
+	last_modified int64
+}
+
+// claims is a struct used to track which record has been indexed for each key during a run, according to a precedence policy.
+type claims struct {
+	policy    string
+	sources   []Source
+	mu        *sync.Mutex
+	claims    map[string]*recordClaim
+	conflicts []*Conflict
+}
+
+// newClaims returns a new `claims` instance for 'policy' and 'sources'.
+func newClaims(policy string, sources []Source) *claims {
+
+	c := &claims{
+		policy:    policy,
+		sources:   sources,
+		mu:        new(sync.Mutex),
+		claims:    make(map[string]*recordClaim),
+		conflicts: make([]*Conflict, 0),
+	}
+
+	return c
+}
+
+// Claim records 'rc' for 'key' and returns a boolean value indicating whether the record should be indexed. If
+// another record has already been claimed for 'key' a `Conflict` is recorded and the precedence policy is used
+// to decide which of the two records wins. Records which win replace the earlier record (the tables being indexed
+// are expected to replace rows with the same key).
+func (c *claims) Claim(key string, rc *recordClaim) bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	existing, ok := c.claims[key]
+
+	if !ok {
+		c.claims[key] = rc
+		return true
+	}
+
+	replace := false
+
+	switch c.policy {
+	case PRECEDENCE_SOURCE_ORDER:
+		replace = rc.source < existing.source
+	case PRECEDENCE_LASTMODIFIED:
+		replace = rc.last_modified > existing.last_modified || (rc.last_modified == existing.last_modified && rc.source < existing.source)
+	default:
+		replace = false
+	}
+
+	kept := existing
+	discarded := rc
+
+	if replace {
+		kept = rc
+		discarded = existing
+		c.claims[key] = rc
+	}
+
+	conflict := &Conflict{
+		Key:             key,
+		KeptPath:        kept.path,
+		KeptSource:      c.sources[kept.source].IteratorURI,
+		DiscardedPath:   discarded.path,
+		DiscardedSource: c.sources[discarded.source].IteratorURI,
+	}
+
+	c.conflicts = append(c.conflicts, conflict)
+	return replace
+}
+
+// Conflicts returns the list of conflicts recorded so far.
+func (c *claims) Conflicts() []*Conflict {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conflicts := make([]*Conflict, len(c.conflicts))
+	copy(conflicts, c.conflicts)
+
+	return conflicts
+}
@@ -0,0 +1,192 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClaims(t *testing.T) {
+
+	sources := []Source{
+		Source{IteratorURI: "repo://"},
+		Source{IteratorURI: "featurecollection://"},
+	}
+
+	tests := map[string]string{
+		PRECEDENCE_FIRST_SEEN:   "b.geojson",
+		PRECEDENCE_SOURCE_ORDER: "a.geojson",
+		PRECEDENCE_LASTMODIFIED: "b.geojson",
+	}
+
+	for policy, expected := range tests {
+
+		c := newClaims(policy, sources)
+
+		a := &recordClaim{path: "a.geojson", source: 0, last_modified: 100}
+		b := &recordClaim{path: "b.geojson", source: 1, last_modified: 200}
+
+		if !c.Claim("1234", b) {
+			t.Fatalf("Expected first claim to succeed for '%s' policy", policy)
+		}
+
+		c.Claim("1234", a)
+
+		conflicts := c.Conflicts()
+
+		if len(conflicts) != 1 {
+			t.Fatalf("Expected 1 conflict for '%s' policy, got %d", policy, len(conflicts))
+		}
+
+		if conflicts[0].KeptPath != expected {
+			t.Fatalf("Expected '%s' policy to keep %s, kept %s", policy, expected, conflicts[0].KeptPath)
+		}
+	}
+}
+
+// PrecedenceExample is a record whose key and last modified time are read from the file it was loaded from.
+type PrecedenceExample struct {
+	Key          string `json:"key"`
+	LastModified int64  `json:"lastmodified"`
+	Path         string `json:"path"`
+}
+
+// KeyedTable is a table that stores the path of the record indexed for each key, replacing earlier rows with the same key.
+type KeyedTable struct{}
+
+func (t *KeyedTable) Name() string {
+	return "keyed"
+}
+
+func (t *KeyedTable) Schema() string {
+	return "CREATE TABLE keyed (key TEXT PRIMARY KEY, path TEXT);"
+}
+
+func (t *KeyedTable) InitializeTable(ctx context.Context, db sqlite.Database) error {
+	return sqlite.CreateTableIfNecessary(ctx, db, t)
+}
+
+func (t *KeyedTable) IndexRecord(ctx context.Context, db sqlite.Database, record interface{}) error {
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	ex := record.(*PrecedenceExample)
+
+	_, err = conn.ExecContext(ctx, "INSERT OR REPLACE INTO keyed (key, path) VALUES (?, ?)", ex.Key, ex.Path)
+	return err
+}
+
+func TestPrecedence(t *testing.T) {
+
+	f := newTestFixture(t, "precedence.db")
+
+	// Both sources contain a record for each of the keys "1" and "2"; the record for "1" in the second
+	// source is newer and the record for "2" in the first source is newer.
+
+	files := map[string]string{
+		"a/1.json": `{"key":"1","lastmodified":100}`,
+		"a/2.json": `{"key":"2","lastmodified":300}`,
+		"b/1.json": `{"key":"1","lastmodified":200}`,
+		"b/2.json": `{"key":"2","lastmodified":200}`,
+	}
+
+	for rel, body := range files {
+
+		path := filepath.Join(f.tmpdir, rel)
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err != nil {
+			t.Fatalf("Failed to create %s, %v", filepath.Dir(path), err)
+		}
+
+		err = os.WriteFile(path, []byte(body), 0644)
+
+		if err != nil {
+			t.Fatalf("Failed to write %s, %v", path, err)
+		}
+	}
+
+	record_func := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+
+		var ex *PrecedenceExample
+
+		err := json.NewDecoder(r).Decode(&ex)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ex.Path = path
+		return ex, nil
+	}
+
+	sources := []Source{
+		Source{IteratorURI: "directory://", URIs: []string{filepath.Join(f.tmpdir, "a")}},
+		Source{IteratorURI: "directory://", URIs: []string{filepath.Join(f.tmpdir, "b")}},
+	}
+
+	tests := map[string]map[string]string{
+		PRECEDENCE_FIRST_SEEN:   {"1": "a", "2": "a"},
+		PRECEDENCE_SOURCE_ORDER: {"1": "a", "2": "a"},
+		PRECEDENCE_LASTMODIFIED: {"1": "b", "2": "a"},
+	}
+
+	for policy, expected := range tests {
+
+		db := f.openDatabase(t, fmt.Sprintf("%s.db", policy))
+
+		keyed_t := &KeyedTable{}
+
+		err := keyed_t.InitializeTable(f.ctx, db)
+
+		if err != nil {
+			t.Fatalf("Failed to create keyed table, %v", err)
+		}
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			DB:             db,
+			Tables:         []sqlite.Table{keyed_t},
+			LoadRecordFunc: record_func,
+			KeyFunc: func(record interface{}) (string, error) {
+				return record.(*PrecedenceExample).Key, nil
+			},
+			LastModifiedFunc: func(record interface{}) (int64, error) {
+				return record.(*PrecedenceExample).LastModified, nil
+			},
+			Precedence: policy,
+		})
+
+		err = idx.IndexSources(f.ctx, sources)
+
+		if err != nil {
+			t.Fatalf("Failed to index sources for '%s' policy, %v", policy, err)
+		}
+
+		if f.count(t, db, "SELECT COUNT(*) FROM keyed") != 2 {
+			t.Fatalf("Expected one row per key for '%s' policy", policy)
+		}
+
+		for key, dir := range expected {
+
+			kept := filepath.Join(f.tmpdir, dir, fmt.Sprintf("%s.json", key))
+
+			if f.count(t, db, "SELECT COUNT(*) FROM keyed WHERE key = ? AND path = ?", key, kept) != 1 {
+				t.Fatalf("Expected '%s' policy to keep %s for key %s", policy, kept, key)
+			}
+		}
+
+		if len(idx.Conflicts()) != 2 {
+			t.Fatalf("Expected 2 conflicts for '%s' policy, got %d", policy, len(idx.Conflicts()))
+		}
+	}
+}
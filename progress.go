@@ -0,0 +1,170 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-iterate/v2/emitter"
+	"github.com/whosonfirst/go-whosonfirst-iterate/v2/iterator"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is a struct describing how far along an indexing run is.
+type Progress struct {
+	// Processed is the number of records processed (indexed, skipped or failed) so far.
+	Processed int64
+	// Total is the total number of records to process. It is zero if the total is unknown, for example because
+	// sources were not pre-scanned or one of them reads from STDIN.
+	Total int64
+	// Elapsed is the time since the run started.
+	Elapsed time.Duration
+	// Rate is the number of records processed per second.
+	Rate float64
+	// ETA is the estimated time remaining. It is zero if `Total` is unknown.
+	ETA time.Duration
+	// Done is a boolean flag indicating whether this is the final report for the run.
+	Done bool
+}
+
+// String returns a human-readable description of the progress, for example "1200/4800 (25.0%) 400.0 records/sec, ETA 9s".
+func (p *Progress) String() string {
+
+	if p.Total == 0 {
+		return fmt.Sprintf("%d %.1f records/sec", p.Processed, p.Rate)
+	}
+
+	pct := float64(p.Processed) / float64(p.Total) * 100.0
+
+	if p.Done {
+		return fmt.Sprintf("%d/%d (%.1f%%) %.1f records/sec, %v", p.Processed, p.Total, pct, p.Rate, p.Elapsed.Round(time.Second))
+	}
+
+	return fmt.Sprintf("%d/%d (%.1f%%) %.1f records/sec, ETA %v", p.Processed, p.Total, pct, p.Rate, p.ETA.Round(time.Second))
+}
+
+// ProgressFunc is a custom function to invoke periodically, and once when a run completes, with the progress of the run.
+type ProgressFunc func(context.Context, *Progress)
+
+// newProgress returns a new `Progress` instance for 'processed' out of 'total' records 'elapsed' after the run started.
+func newProgress(processed int64, total int64, elapsed time.Duration) *Progress {
+
+	p := &Progress{
+		Processed: processed,
+		Total:     total,
+		Elapsed:   elapsed,
+	}
+
+	if elapsed > 0 {
+		p.Rate = float64(processed) / elapsed.Seconds()
+	}
+
+	if total > 0 && p.Rate > 0 && processed < total {
+		remaining := float64(total-processed) / p.Rate
+		p.ETA = time.Duration(remaining * float64(time.Second))
+	}
+
+	return p
+}
+
+// countSources returns the total number of records in 'sources' (that are included in the indexer's sample, up to its limit)
+// by iterating each of them without loading any records. Paths listed by more than one source are counted once. If any of the sources reads from STDIN, and so can not be iterated
+// twice, zero is returned.
+func (idx *SQLiteIndexer) countSources(ctx context.Context, sources []Source) (int64, error) {
+
+	for _, src := range sources {
+
+		for _, uri := range src.URIs {
+
+			if uri == emitter.STDIN {
+				return 0, nil
+			}
+		}
+	}
+
+	total := int64(0)
+
+	// Paths are only counted once, in the same way that records whose path has already been
+	// processed are skipped during a run with more than one source
+
+	var seen_paths *sync.Map
+
+	if len(sources) > 1 {
+		seen_paths = new(sync.Map)
+	}
+
+	for _, src := range sources {
+
+		src := src
+
+		cb := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) error {
+
+			if !isSampled(samplePath(src, path), idx.sample_rate, idx.sample_seed) {
+				return nil
+			}
+
+			if seen_paths != nil {
+
+				_, loaded := seen_paths.LoadOrStore(path, true)
+
+				if loaded {
+					return nil
+				}
+			}
+
+			atomic.AddInt64(&total, 1)
+			return nil
+		}
+
+		iter, err := iterator.NewIterator(ctx, src.IteratorURI, cb)
+
+		if err != nil {
+			return 0, fmt.Errorf("Failed to create new iterator for %s, %w", src.IteratorURI, err)
+		}
+
+		err = iter.IterateURIs(ctx, src.URIs...)
+
+		if err != nil {
+			return 0, fmt.Errorf("Failed to count records in %s source, %w", src.IteratorURI, err)
+		}
+	}
+
+	if idx.limit > 0 && total > idx.limit {
+		total = idx.limit
+	}
+
+	return total, nil
+}
+
+// reportProgress invokes the indexer's progress function for 'run' every progress interval until 'done_ch' is closed,
+// and then one final time.
+func (idx *SQLiteIndexer) reportProgress(ctx context.Context, run *indexRun, done_ch <-chan bool) {
+
+	t1 := time.Now()
+
+	report := func(done bool) {
+		p := newProgress(run.counts.completed(), run.total, time.Since(t1))
+		p.Done = done
+
+		// Progress functions are only informational so a panic is logged (by safeCall) but does not stop the run
+
+		idx.safeCall(ctx, run, nil, "", func(ctx context.Context) error {
+			idx.progress_func(ctx, p)
+			return nil
+		})
+	}
+
+	ticker := time.NewTicker(idx.progress_interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done_ch:
+			report(true)
+			return
+		case <-ticker.C:
+			report(false)
+		}
+	}
+}
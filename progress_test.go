@@ -0,0 +1,81 @@
+package index
+
+import (
+	"context"
+	"github.com/whosonfirst/go-whosonfirst-iterate/v2/emitter"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+
+	f := newTestFixture(t, "progress.db")
+
+	mu := new(sync.Mutex)
+	reports := make([]*Progress, 0)
+
+	progress_func := func(ctx context.Context, p *Progress) {
+		mu.Lock()
+		reports = append(reports, p)
+		mu.Unlock()
+	}
+
+	idx := f.indexer(t, &SQLiteIndexerOptions{
+		PreScan:          true,
+		ProgressFunc:     progress_func,
+		ProgressInterval: time.Millisecond,
+	})
+
+	err := idx.IndexURIs(f.ctx, "directory://", f.path("cmd"), f.path("config"))
+
+	if err != nil {
+		t.Fatalf("Failed to index records, %v", err)
+	}
+
+	if len(reports) == 0 {
+		t.Fatalf("Expected progress reports")
+	}
+
+	last := reports[len(reports)-1]
+
+	if !last.Done || last.Total < 3 || last.Processed != last.Total {
+		t.Fatalf("Unexpected final progress report %v", last)
+	}
+
+	total, err := idx.countSources(f.ctx, []Source{Source{IteratorURI: "file://", URIs: []string{emitter.STDIN}}})
+
+	if err != nil || total != 0 {
+		t.Fatalf("Expected STDIN sources not to be counted, %d %v", total, err)
+	}
+
+	// Paths listed by more than one source are only counted once
+
+	src := Source{IteratorURI: "directory://", URIs: []string{f.path("config")}}
+
+	once, err := idx.countSources(f.ctx, []Source{src})
+
+	if err != nil {
+		t.Fatalf("Failed to count records, %v", err)
+	}
+
+	twice, err := idx.countSources(f.ctx, []Source{src, src})
+
+	if err != nil || twice != once {
+		t.Fatalf("Expected duplicate paths to be counted once, got %d (expected %d) %v", twice, once, err)
+	}
+
+	// Records that have been seen but are still being processed are not included
+
+	counts := &runCounts{seen: 5, indexed: 2, skipped: 1, failed: 1}
+
+	if counts.completed() != 4 {
+		t.Fatalf("Expected 4 completed records, got %d", counts.completed())
+	}
+
+	p := newProgress(25, 100, 5*time.Second)
+
+	if p.Rate != 5.0 || p.ETA != 15*time.Second {
+		t.Fatalf("Unexpected progress %v", p)
+	}
+}
@@ -0,0 +1,96 @@
+package index
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// RECORD_SOURCES_TABLE is the name of the table used to record the provenance of each record that has been indexed.
+const RECORD_SOURCES_TABLE string = "_record_sources"
+
+// hashRecord returns the hex-encoded SHA-256 hash of the body of 'r' and then rewinds 'r' so that it can be read again.
+func hashRecord(r io.ReadSeeker) (string, error) {
+
+	h := sha256.New()
+
+	_, err := io.Copy(h, r)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to read record, %w", err)
+	}
+
+	_, err = r.Seek(0, 0)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to rewind record, %w", err)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// ensureProvenanceTable creates the `_record_sources` table if it does not already exist.
+func (idx *SQLiteIndexer) ensureProvenanceTable(ctx context.Context) error {
+
+	idx.db.Lock(ctx)
+	defer idx.db.Unlock(ctx)
+
+	conn, err := idx.db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		key TEXT NOT NULL PRIMARY KEY,
+		path TEXT NOT NULL,
+		iterator_uri TEXT NOT NULL,
+		run_id TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		indexed INTEGER NOT NULL,
+		tables TEXT NOT NULL
+	)`, RECORD_SOURCES_TABLE)
+
+	_, err = conn.ExecContext(ctx, q)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create %s table, %w", RECORD_SOURCES_TABLE, err)
+	}
+
+	return nil
+}
+
+// recordProvenance writes (or replaces) the row in the `_record_sources` table for 'lr', which was indexed in the
+// tables named in 'tables' during 'run'. It assumes the caller is holding the database lock.
+func (idx *SQLiteIndexer) recordProvenance(ctx context.Context, run *indexRun, lr *loadedRecord, tables []string) error {
+
+	conn, err := idx.db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	enc_tables, err := json.Marshal(tables)
+
+	if err != nil {
+		return fmt.Errorf("Failed to marshal tables, %w", err)
+	}
+
+	q := fmt.Sprintf(`INSERT OR REPLACE INTO %s (
+		key, path, iterator_uri, run_id, hash, indexed, tables
+	) VALUES (
+		?, ?, ?, ?, ?, ?, ?
+	)`, RECORD_SOURCES_TABLE)
+
+	iterator_uri := run.sources[lr.source].IteratorURI
+
+	_, err = conn.ExecContext(ctx, q, lr.key, lr.path, iterator_uri, run.id, lr.hash, run.started.Unix(), string(enc_tables))
+
+	if err != nil {
+		return fmt.Errorf("Failed to write %s row, %w", RECORD_SOURCES_TABLE, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package index
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestTrackProvenance(t *testing.T) {
+
+	f := newTestFixture(t, "provenance.db")
+
+	idx := f.indexer(t, &SQLiteIndexerOptions{
+		LoadRecordFunc:  pathRecord,
+		KeyFunc:         pathKey,
+		TrackProvenance: true,
+	})
+
+	err := idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	if err != nil {
+		t.Fatalf("Failed to index URIs, %v", err)
+	}
+
+	path := f.path("config", "config.go")
+
+	body, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatalf("Failed to read %s, %v", path, err)
+	}
+
+	expected_hash := fmt.Sprintf("%x", sha256.Sum256(body))
+
+	conn, err := f.db.Conn(f.ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to establish database connection, %v", err)
+	}
+
+	var iterator_uri string
+	var hash string
+	var str_tables string
+
+	q := "SELECT iterator_uri, hash, tables FROM _record_sources WHERE key = ?"
+	err = conn.QueryRowContext(f.ctx, q, path).Scan(&iterator_uri, &hash, &str_tables)
+
+	if err != nil {
+		t.Fatalf("Failed to read provenance for %s, %v", path, err)
+	}
+
+	if iterator_uri != "directory://" || hash != expected_hash || str_tables != `["example"]` {
+		t.Fatalf("Unexpected provenance for %s: %s %s %s", path, iterator_uri, hash, str_tables)
+	}
+
+	// Every record indexed during a run is given the same time so that it does not depend on how long the run took
+
+	if f.count(t, f.db, "SELECT COUNT(DISTINCT indexed) FROM _record_sources") != 1 {
+		t.Fatalf("Expected every record to have the run's start time")
+	}
+}
@@ -0,0 +1,122 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// reproducible_pragmas are the pragmas applied to a database before a reproducible build so that the
+// resulting file does not depend on settings inherited from the environment or an earlier run.
+var reproducible_pragmas = []string{
+	"PRAGMA PAGE_SIZE=4096",
+	"PRAGMA AUTO_VACUUM=NONE",
+	"PRAGMA ENCODING='UTF-8'",
+	"PRAGMA JOURNAL_MODE=DELETE",
+}
+
+// recordBuffer is a struct used to hold loaded records in memory until they can be sorted and written during a reproducible build.
+type recordBuffer struct {
+	mu      *sync.Mutex
+	records []*loadedRecord
+}
+
+// newRecordBuffer returns a new (empty) `recordBuffer` instance.
+func newRecordBuffer() *recordBuffer {
+
+	b := &recordBuffer{
+		mu:      new(sync.Mutex),
+		records: make([]*loadedRecord, 0),
+	}
+
+	return b
+}
+
+// Add appends 'r' to the buffer.
+func (b *recordBuffer) Add(r *loadedRecord) {
+	b.mu.Lock()
+	b.records = append(b.records, r)
+	b.mu.Unlock()
+}
+
+// Sorted returns the records in the buffer sorted by key, then source offset, then path.
+func (b *recordBuffer) Sorted() []*loadedRecord {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	records := make([]*loadedRecord, len(b.records))
+	copy(records, b.records)
+
+	sort.SliceStable(records, func(i, j int) bool {
+
+		if records[i].key != records[j].key {
+			return records[i].key < records[j].key
+		}
+
+		if records[i].source != records[j].source {
+			return records[i].source < records[j].source
+		}
+
+		return records[i].path < records[j].path
+	})
+
+	return records
+}
+
+// applyReproduciblePragmas applies the `reproducible_pragmas` to the indexer's database.
+func (idx *SQLiteIndexer) applyReproduciblePragmas(ctx context.Context) error {
+
+	conn, err := idx.db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	for _, p := range reproducible_pragmas {
+
+		_, err = conn.ExecContext(ctx, p)
+
+		if err != nil {
+			return fmt.Errorf("Failed to set pragma '%s', %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+// flushRecords writes the records buffered during 'run', sorted by key, to the indexer's tables and then vacuums
+// the database so that its layout does not depend on the history of writes.
+func (idx *SQLiteIndexer) flushRecords(ctx context.Context, run *indexRun) error {
+
+	for _, r := range run.buffer.Sorted() {
+
+		err := idx.writeRecord(ctx, run, r)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if idx.dry_run {
+		return nil
+	}
+
+	conn, err := idx.db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	idx.db.Lock(ctx)
+	defer idx.db.Unlock(ctx)
+
+	_, err = conn.ExecContext(ctx, "VACUUM")
+
+	if err != nil {
+		return &DatabaseError{Op: "vacuum database", Err: err}
+	}
+
+	return nil
+}
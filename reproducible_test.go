@@ -0,0 +1,74 @@
+package index
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/aaronland/go-sqlite/v2/tables"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReproducibleIndexing(t *testing.T) {
+
+	f := newTestFixture(t, "reproducible.db")
+
+	// Paths are made relative so that the records (and so the databases) are the same wherever the tests are run
+
+	record_func := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+		rel_path, _ := filepath.Rel(f.cwd, path)
+		return json.Marshal(PathExample{Path: rel_path})
+	}
+
+	build := func(name string) string {
+
+		db := f.openDatabase(t, name)
+
+		ex_t, err := tables.NewExampleTableWithDatabase(f.ctx, db)
+
+		if err != nil {
+			t.Fatalf("Failed to create example table, %v", err)
+		}
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			DB:             db,
+			Tables:         []sqlite.Table{ex_t},
+			LoadRecordFunc: record_func,
+			KeyFunc:        pathKey,
+			Reproducible:   true,
+		})
+
+		err = idx.IndexURIs(f.ctx, "directory://", f.path("config"), f.path("cmd"))
+
+		if err != nil {
+			t.Fatalf("Failed to index URIs, %v", err)
+		}
+
+		err = db.Close(f.ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to close database, %v", err)
+		}
+
+		db_path := filepath.Join(f.tmpdir, name)
+
+		body, err := os.ReadFile(db_path)
+
+		if err != nil {
+			t.Fatalf("Failed to read %s, %v", db_path, err)
+		}
+
+		return fmt.Sprintf("%x", sha256.Sum256(body))
+	}
+
+	a := build("a.db")
+	b := build("b.db")
+
+	if a != b {
+		t.Fatalf("Expected identical databases, got %s and %s", a, b)
+	}
+}
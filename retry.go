@@ -0,0 +1,155 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SQLite primary result codes for errors that are (usually) caused by another connection or process and resolve themselves.
+const (
+	sqlite_busy   int = 5
+	sqlite_locked int = 6
+)
+
+// transient_messages is the list of error message fragments used to identify transient errors returned by database
+// drivers that do not expose SQLite result codes.
+var transient_messages = []string{
+	"database is locked",
+	"database table is locked",
+	"SQLITE_BUSY",
+	"SQLITE_LOCKED",
+}
+
+// RetryPolicy is a struct describing how operations that fail with a transient SQLite error (SQLITE_BUSY or SQLITE_LOCKED)
+// should be retried.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of times to retry an operation. If zero operations are not retried.
+	MaxRetries int
+	// InitialBackoff is the time to wait before the first retry. It is doubled after each subsequent retry.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum time to wait between retries.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the `RetryPolicy` used when one is not explicitly defined.
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxRetries:     5,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+}
+
+// validate returns an error if 'p' is not a valid retry policy.
+func (p *RetryPolicy) validate() error {
+
+	if p.MaxRetries < 0 {
+		return fmt.Errorf("MaxRetries must not be negative")
+	}
+
+	if p.InitialBackoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("Backoff durations must not be negative")
+	}
+
+	return nil
+}
+
+// backoff returns the time to wait before retry 'attempt' (starting at 1).
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+
+	d := p.InitialBackoff
+
+	for i := 1; i < attempt; i++ {
+
+		d = d * 2
+
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	return d
+}
+
+// IsTransientError returns a boolean value indicating whether 'err' is a transient SQLite error (SQLITE_BUSY or SQLITE_LOCKED)
+// that may succeed if retried. Other errors, for example constraint or schema errors, are not transient.
+func IsTransientError(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	var coded interface{ Code() int }
+
+	if errors.As(err, &coded) {
+
+		switch coded.Code() & 0xff {
+		case sqlite_busy, sqlite_locked:
+			return true
+		default:
+			return false
+		}
+	}
+
+	msg := err.Error()
+
+	for _, m := range transient_messages {
+
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withRetries invokes 'fn', retrying it according to the indexer's retry policy for as long as it fails with a transient error.
+// Each retry is counted in 'run'. 'label' is invoked, only if necessary, to describe the operation in log messages.
+func (idx *SQLiteIndexer) withRetries(ctx context.Context, run *indexRun, label func() string, fn func() error) error {
+
+	attempt := 0
+
+	for {
+
+		err := fn()
+
+		if err == nil || !IsTransientError(err) || attempt >= idx.retry_policy.MaxRetries {
+			return err
+		}
+
+		attempt += 1
+		atomic.AddInt64(&run.counts.retried, 1)
+
+		backoff := idx.retry_policy.backoff(attempt)
+
+		run.logger.Warn("Retrying after transient database error", "operation", label(), "backoff", backoff, "attempt", attempt, "max_retries", idx.retry_policy.MaxRetries, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Cancelled while waiting to retry %s, %w", label(), err)
+		case <-time.After(backoff):
+			// pass
+		}
+	}
+}
+
+// reportRetries stores the number of retries performed during 'run' so it can be retrieved by the `Retries` method
+// and logs it.
+func (idx *SQLiteIndexer) reportRetries(run *indexRun) {
+
+	retries := atomic.LoadInt64(&run.counts.retried)
+
+	idx.mu.Lock()
+	idx.retries = retries
+	idx.mu.Unlock()
+
+	if retries > 0 {
+		run.logger.Info("Retried operations after transient database errors", "retries", retries)
+	}
+}
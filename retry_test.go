@@ -0,0 +1,93 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"testing"
+	"time"
+)
+
+type BusyTable struct {
+	FailingTable
+	Failures int
+	Err      error
+}
+
+func (t *BusyTable) IndexRecord(ctx context.Context, db sqlite.Database, record interface{}) error {
+
+	if t.Failures > 0 {
+		t.Failures -= 1
+		return t.Err
+	}
+
+	return nil
+}
+
+func TestIsTransientError(t *testing.T) {
+
+	tests := map[string]bool{
+		"database is locked (5) (SQLITE_BUSY)": true,
+		"database table is locked":             true,
+		"UNIQUE constraint failed: example.id": false,
+		"no such table: example":               false,
+		"context deadline exceeded":            false,
+	}
+
+	for msg, expected := range tests {
+
+		if IsTransientError(fmt.Errorf("Failed to index record, %w", errors.New(msg))) != expected {
+			t.Fatalf("Unexpected result for '%s', expected %t", msg, expected)
+		}
+	}
+
+	if IsTransientError(nil) {
+		t.Fatalf("Expected nil error not to be transient")
+	}
+}
+
+func TestRetries(t *testing.T) {
+
+	f := newTestFixture(t, "retry.db")
+
+	build := func(table sqlite.Table) (*SQLiteIndexer, error) {
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			Tables: []sqlite.Table{table},
+			RetryPolicy: &RetryPolicy{
+				MaxRetries:     3,
+				InitialBackoff: time.Millisecond,
+				MaxBackoff:     5 * time.Millisecond,
+			},
+		})
+
+		return idx, idx.IndexURIs(f.ctx, "directory://", f.path("cmd"))
+	}
+
+	idx, err := build(&BusyTable{Failures: 2, Err: fmt.Errorf("database is locked (5) (SQLITE_BUSY)")})
+
+	if err != nil {
+		t.Fatalf("Expected transient errors to be retried, %v", err)
+	}
+
+	if idx.Retries() != 2 {
+		t.Fatalf("Expected 2 retries, got %d", idx.Retries())
+	}
+
+	_, err = build(&BusyTable{Failures: 4, Err: fmt.Errorf("database is locked (5) (SQLITE_BUSY)")})
+
+	if err == nil {
+		t.Fatalf("Expected error after exceeding maximum number of retries")
+	}
+
+	idx, err = build(&BusyTable{Failures: 1, Err: fmt.Errorf("UNIQUE constraint failed: names.id")})
+
+	if err == nil {
+		t.Fatalf("Expected constraint error not to be retried")
+	}
+
+	if idx.Retries() != 0 {
+		t.Fatalf("Expected 0 retries, got %d", idx.Retries())
+	}
+}
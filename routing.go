@@ -0,0 +1,108 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"github.com/aaronland/go-json-query"
+	"github.com/aaronland/go-sqlite/v2"
+)
+
+// SQLiteIndexerRoutingFunc is a custom function that returns a boolean value indicating whether a record should be indexed in a given table.
+type SQLiteIndexerRoutingFunc func(context.Context, interface{}) (bool, error)
+
+// NewQueryRoutingFunc returns a `SQLiteIndexerRoutingFunc` that matches records using one or more `aaronland/go-json-query`
+// {PATH}={REGULAR_EXPRESSION} strings. 'mode' is a valid `aaronland/go-json-query` query set mode (ALL or ANY); if empty ALL is
+// assumed. Records are expected to be JSON-encoded byte slices, strings or anything that can be marshaled as JSON.
+func NewQueryRoutingFunc(queries []string, mode string) (SQLiteIndexerRoutingFunc, error) {
+
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("No queries defined")
+	}
+
+	switch mode {
+	case "":
+		mode = query.QUERYSET_MODE_ALL
+	case query.QUERYSET_MODE_ALL, query.QUERYSET_MODE_ANY:
+		// pass
+	default:
+		return nil, fmt.Errorf("Invalid query mode '%s'", mode)
+	}
+
+	var flags query.QueryFlags
+
+	for _, q := range queries {
+
+		err := flags.Set(q)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid query '%s', %w", q, err)
+		}
+	}
+
+	qs := &query.QuerySet{
+		Queries: flags,
+		Mode:    mode,
+	}
+
+	fn := func(ctx context.Context, record interface{}) (bool, error) {
+
+		body, err := recordBody(record)
+
+		if err != nil {
+			return false, err
+		}
+
+		return query.Matches(ctx, qs, body)
+	}
+
+	return fn, nil
+}
+
+// routeRecord returns the list of the indexer's tables that 'lr' should be indexed in, excluding any tables that
+// have been disabled during 'run', and the number of tables whose routing function failed. Routing failures are
+// handled according to each table's policy.
+func (idx *SQLiteIndexer) routeRecord(ctx context.Context, run *indexRun, lr *loadedRecord) ([]sqlite.Table, int, error) {
+
+	routed := make([]sqlite.Table, 0)
+	failed := 0
+
+	for _, t := range idx.tables {
+
+		if run.failures.IsDisabled(t.Name()) {
+			continue
+		}
+
+		route_func, ok := idx.table_routes[t.Name()]
+
+		if !ok {
+			routed = append(routed, t)
+			continue
+		}
+
+		var matches bool
+
+		err := idx.safeCall(ctx, run, lr, t.Name(), func(ctx context.Context) error {
+			m, err := route_func(ctx, lr.record)
+			matches = m
+			return err
+		})
+
+		if err != nil {
+
+			err = idx.tableFailed(run, lr, t.Name(), fmt.Errorf("Failed to route record, %w", err))
+
+			if err != nil {
+				return nil, failed, err
+			}
+
+			failed += 1
+			continue
+		}
+
+		if matches {
+			routed = append(routed, t)
+		}
+	}
+
+	return routed, failed, nil
+}
@@ -0,0 +1,47 @@
+package index
+
+import (
+	"testing"
+)
+
+func TestTableRoutes(t *testing.T) {
+
+	f := newTestFixture(t, "routing.db")
+
+	route_func, err := NewQueryRoutingFunc([]string{`path=_test\.go$`}, "")
+
+	if err != nil {
+		t.Fatalf("Failed to create query routing function, %v", err)
+	}
+
+	idx_opts := &SQLiteIndexerOptions{
+		LoadRecordFunc: pathRecord,
+		TableRoutes: map[string]SQLiteIndexerRoutingFunc{
+			f.example.Name(): route_func,
+		},
+	}
+
+	idx := f.indexer(t, idx_opts)
+
+	err = idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	if err != nil {
+		t.Fatalf("Failed to index URIs, %v", err)
+	}
+
+	count := f.count(t, f.db, "SELECT COUNT(*) FROM example")
+
+	if count != 1 {
+		t.Fatalf("Expected only config_test.go to be routed to example table, got %d rows", count)
+	}
+
+	idx_opts.TableRoutes = map[string]SQLiteIndexerRoutingFunc{
+		"search": route_func,
+	}
+
+	_, err = NewSQLiteIndexer(idx_opts)
+
+	if err == nil {
+		t.Fatalf("Expected routing function for unknown table to fail")
+	}
+}
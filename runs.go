@@ -0,0 +1,268 @@
+package index
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// INDEX_RUNS_TABLE is the name of the table used to record metadata about each indexing run.
+const INDEX_RUNS_TABLE string = "_index_runs"
+
+// RunSource is a struct describing a source processed during a run, as recorded in the `_index_runs` table.
+type RunSource struct {
+	// IteratorURI is the `whosonfirst/go-whosonfirst-iterate/v2` URI used to process the source.
+	IteratorURI string `json:"iterator_uri"`
+	// URIs is the list of URIs processed by the iterator.
+	URIs []string `json:"uris"`
+	// Commits is an optional map of URIs and the Git commit hash they were checked out at. It is only
+	// populated for `repo://` sources that are Git repositories.
+	Commits map[string]string `json:"commits,omitempty"`
+}
+
+// runCounts is a struct containing the counts of records processed during a run.
+type runCounts struct {
+	// seen is the number of records dispatched to the indexer.
+	seen int64
+	// indexed is the number of records written to the indexer's tables.
+	indexed int64
+	// skipped is the number of records that were not indexed because they were empty, duplicates or superseded by another record.
+	skipped int64
+	// failed is the number of records that could not be indexed because of an error.
+	failed int64
+	// invalid is the number of records that failed one or more validators.
+	invalid int64
+	// retried is the number of times an operation was retried after a transient database error.
+	retried int64
+}
+
+// completed returns the number of records that have been indexed, skipped or failed. Unlike 'seen' it does not include
+// records that have been dispatched to the indexer but are still being processed (or are buffered to be written later).
+func (c *runCounts) completed() int64 {
+	return atomic.LoadInt64(&c.indexed) + atomic.LoadInt64(&c.skipped) + atomic.LoadInt64(&c.failed)
+}
+
+// RunStats is a struct containing the counts of records processed during a run.
+type RunStats struct {
+	// Seen is the number of records dispatched to the indexer.
+	Seen int64
+	// Indexed is the number of records written to the indexer's tables (or that would have been written, during a dry run).
+	Indexed int64
+	// Skipped is the number of records that were not indexed because they were empty, duplicates or superseded by another record.
+	Skipped int64
+	// Failed is the number of records that could not be indexed because of an error.
+	Failed int64
+	// Invalid is the number of records that failed one or more validators. Invalid records are also counted as
+	// failed or, if the validation policy is TABLE_POLICY_BEST_EFFORT, skipped.
+	Invalid int64
+	// Retries is the number of times an operation was retried after a transient database error.
+	Retries int64
+}
+
+// reportStats stores the counts of records processed during 'run' so they can be retrieved by the `Stats` method.
+func (idx *SQLiteIndexer) reportStats(run *indexRun) {
+
+	stats := &RunStats{
+		Seen:    atomic.LoadInt64(&run.counts.seen),
+		Indexed: atomic.LoadInt64(&run.counts.indexed),
+		Skipped: atomic.LoadInt64(&run.counts.skipped),
+		Failed:  atomic.LoadInt64(&run.counts.failed),
+		Invalid: atomic.LoadInt64(&run.counts.invalid),
+		Retries: atomic.LoadInt64(&run.counts.retried),
+	}
+
+	idx.mu.Lock()
+	idx.stats = stats
+	idx.mu.Unlock()
+}
+
+// recordRun writes a row describing 'run', including the number of failures for each table that is not required,
+// to the `_index_runs` table. If 'run_err' is not nil its message is recorded
+// alongside the other metadata.
+func (idx *SQLiteIndexer) recordRun(ctx context.Context, run *indexRun, run_err error) error {
+
+	idx.db.Lock(ctx)
+	defer idx.db.Unlock(ctx)
+
+	conn, err := idx.db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id TEXT NOT NULL PRIMARY KEY,
+		started INTEGER NOT NULL,
+		finished INTEGER NOT NULL,
+		sources TEXT NOT NULL,
+		tables TEXT NOT NULL,
+		seen INTEGER NOT NULL,
+		indexed INTEGER NOT NULL,
+		skipped INTEGER NOT NULL,
+		failed INTEGER NOT NULL,
+		table_failures TEXT NOT NULL,
+		error TEXT
+	)`, INDEX_RUNS_TABLE)
+
+	_, err = conn.ExecContext(ctx, q)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create %s table, %w", INDEX_RUNS_TABLE, err)
+	}
+
+	run_sources := make([]*RunSource, len(run.sources))
+
+	for i, src := range run.sources {
+		run_sources[i] = runSource(src)
+	}
+
+	enc_sources, err := json.Marshal(run_sources)
+
+	if err != nil {
+		return fmt.Errorf("Failed to marshal sources, %w", err)
+	}
+
+	table_names := make([]string, len(idx.tables))
+
+	for i, t := range idx.tables {
+		table_names[i] = t.Name()
+	}
+
+	enc_tables, err := json.Marshal(table_names)
+
+	if err != nil {
+		return fmt.Errorf("Failed to marshal tables, %w", err)
+	}
+
+	enc_failures, err := json.Marshal(run.failures.Counts())
+
+	if err != nil {
+		return fmt.Errorf("Failed to marshal table failures, %w", err)
+	}
+
+	var str_err interface{}
+
+	if run_err != nil {
+		str_err = run_err.Error()
+	}
+
+	q = fmt.Sprintf(`INSERT OR REPLACE INTO %s (
+		id, started, finished, sources, tables, seen, indexed, skipped, failed, table_failures, error
+	) VALUES (
+		?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+	)`, INDEX_RUNS_TABLE)
+
+	_, err = conn.ExecContext(ctx, q,
+		run.id,
+		run.started.Unix(),
+		time.Now().Unix(),
+		string(enc_sources),
+		string(enc_tables),
+		atomic.LoadInt64(&run.counts.seen),
+		atomic.LoadInt64(&run.counts.indexed),
+		atomic.LoadInt64(&run.counts.skipped),
+		atomic.LoadInt64(&run.counts.failed),
+		string(enc_failures),
+		str_err,
+	)
+
+	if err != nil {
+		return fmt.Errorf("Failed to record run %s, %w", run.id, err)
+	}
+
+	return nil
+}
+
+// runSource returns a `RunSource` instance for 'src', including Git commit hashes for the URIs of `repo://` sources
+// where they can be determined.
+func runSource(src Source) *RunSource {
+
+	rs := &RunSource{
+		IteratorURI: src.IteratorURI,
+		URIs:        src.URIs,
+	}
+
+	u, err := url.Parse(src.IteratorURI)
+
+	if err != nil || u.Scheme != "repo" {
+		return rs
+	}
+
+	commits := make(map[string]string)
+
+	for _, uri := range src.URIs {
+
+		commit, err := gitCommit(uri)
+
+		if err == nil && commit != "" {
+			commits[uri] = commit
+		}
+	}
+
+	if len(commits) > 0 {
+		rs.Commits = commits
+	}
+
+	return rs
+}
+
+// gitCommit returns the commit hash that HEAD points to for the Git repository at 'path' by reading the files
+// in its `.git` directory directly (rather than depending on a `git` binary being present).
+func gitCommit(path string) (string, error) {
+
+	git_dir := filepath.Join(path, ".git")
+
+	head, err := os.ReadFile(filepath.Join(git_dir, "HEAD"))
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to read HEAD, %w", err)
+	}
+
+	str_head := strings.TrimSpace(string(head))
+
+	if !strings.HasPrefix(str_head, "ref: ") {
+		return str_head, nil
+	}
+
+	ref := strings.TrimPrefix(str_head, "ref: ")
+
+	body, err := os.ReadFile(filepath.Join(git_dir, filepath.FromSlash(ref)))
+
+	if err == nil {
+		return strings.TrimSpace(string(body)), nil
+	}
+
+	fh, err := os.Open(filepath.Join(git_dir, "packed-refs"))
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to open packed-refs, %w", err)
+	}
+
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+
+	for scanner.Scan() {
+
+		parts := strings.Fields(scanner.Text())
+
+		if len(parts) == 2 && parts[1] == ref {
+			return parts[0], nil
+		}
+	}
+
+	err = scanner.Err()
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to read packed-refs, %w", err)
+	}
+
+	return "", fmt.Errorf("Failed to resolve %s", ref)
+}
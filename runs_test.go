@@ -0,0 +1,111 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordRuns(t *testing.T) {
+
+	f := newTestFixture(t, "runs.db")
+
+	idx := f.indexer(t, &SQLiteIndexerOptions{
+		RecordRuns: true,
+	})
+
+	uri := f.path("config")
+
+	err := idx.IndexURIs(f.ctx, "directory://", uri)
+
+	if err != nil {
+		t.Fatalf("Failed to index URIs, %v", err)
+	}
+
+	conn, err := f.db.Conn(f.ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to establish database connection, %v", err)
+	}
+
+	var id string
+	var str_sources string
+	var seen int64
+	var indexed int64
+
+	err = conn.QueryRowContext(f.ctx, "SELECT id, sources, seen, indexed FROM _index_runs").Scan(&id, &str_sources, &seen, &indexed)
+
+	if err != nil {
+		t.Fatalf("Failed to read run, %v", err)
+	}
+
+	if id == "" || seen == 0 || seen != indexed {
+		t.Fatalf("Unexpected run metadata: id '%s', seen %d, indexed %d", id, seen, indexed)
+	}
+
+	var sources []*RunSource
+
+	err = json.Unmarshal([]byte(str_sources), &sources)
+
+	if err != nil {
+		t.Fatalf("Failed to unmarshal sources, %v", err)
+	}
+
+	if len(sources) != 1 || sources[0].URIs[0] != uri {
+		t.Fatalf("Unexpected sources: %s", str_sources)
+	}
+
+	// Runs are recorded before the database is swapped so a failure to swap must update the recorded run
+
+	idx = f.indexer(t, &SQLiteIndexerOptions{
+		RecordRuns: true,
+		SwapPath:   filepath.Join(f.tmpdir, "missing", "published.db"),
+	})
+
+	err = idx.IndexURIs(f.ctx, "directory://", uri)
+
+	if err == nil {
+		t.Fatalf("Expected swap to a missing directory to fail")
+	}
+
+	if f.count(t, f.db, "SELECT COUNT(*) FROM _index_runs WHERE error LIKE '%swap database%'") != 1 {
+		t.Fatalf("Expected failed swap to be recorded")
+	}
+}
+
+func TestGitCommit(t *testing.T) {
+
+	root := t.TempDir()
+	git_dir := filepath.Join(root, ".git")
+
+	err := os.MkdirAll(filepath.Join(git_dir, "refs", "heads"), 0755)
+
+	if err != nil {
+		t.Fatalf("Failed to create %s, %v", git_dir, err)
+	}
+
+	commit := "5a77edd95346fff66550b54bdbf8996da6444089"
+
+	os.WriteFile(filepath.Join(git_dir, "HEAD"), []byte("ref: refs/heads/main\n"), 0644)
+	os.WriteFile(filepath.Join(git_dir, "packed-refs"), []byte(fmt.Sprintf("# pack-refs with: peeled\n%s refs/heads/main\n", commit)), 0644)
+
+	v, err := gitCommit(root)
+
+	if err != nil {
+		t.Fatalf("Failed to derive commit from packed-refs, %v", err)
+	}
+
+	if v != commit {
+		t.Fatalf("Unexpected commit '%s'", v)
+	}
+
+	os.WriteFile(filepath.Join(git_dir, "refs", "heads", "main"), []byte("abc123\n"), 0644)
+
+	v, err = gitCommit(root)
+
+	if err != nil || v != "abc123" {
+		t.Fatalf("Failed to derive commit from loose ref, %s %v", v, err)
+	}
+}
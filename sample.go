@@ -0,0 +1,83 @@
+package index
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// isSampled returns a boolean value indicating whether the record at 'path' is included in a sample of 'rate'
+// (between 0 and 1) for 'seed'. The decision is derived from a hash of 'seed' and 'path' so it is the same every
+// time a given path is processed with the same rate and seed.
+func isSampled(path string, rate float64, seed int64) bool {
+
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+
+	h := fnv.New64a()
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(seed))
+
+	h.Write(b[:])
+	h.Write([]byte(path))
+
+	return float64(h.Sum64())/float64(math.MaxUint64) < rate
+}
+
+// samplePath returns 'path' relative to whichever of the URIs in 'src' contains it, so that a record is sampled the same
+// way wherever its source is located, or 'path' itself if none of them do (for example if the source is not a directory).
+func samplePath(src Source, path string) string {
+
+	for _, uri := range src.URIs {
+
+		root, err := filepath.Abs(uri)
+
+		if err != nil {
+			continue
+		}
+
+		rel, err := filepath.Rel(root, path)
+
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+
+		if rel == "." {
+			rel = filepath.Base(path)
+		}
+
+		return filepath.ToSlash(rel)
+	}
+
+	return path
+}
+
+// admitRecord returns a boolean value indicating whether the record at 'path', produced by the source at offset
+// 'source' in 'run', should be processed given the indexer's sample rate and limit. Once the limit has been reached
+// the iteration of the run's sources is stopped.
+func (idx *SQLiteIndexer) admitRecord(run *indexRun, source int, path string) bool {
+
+	if idx.sample_rate > 0 && idx.sample_rate < 1 {
+
+		if !isSampled(samplePath(run.sources[source], path), idx.sample_rate, idx.sample_seed) {
+			return false
+		}
+	}
+
+	if idx.limit <= 0 {
+		return true
+	}
+
+	admitted := atomic.AddInt64(&run.admitted, 1)
+
+	if admitted == idx.limit && run.stop != nil {
+		run.stop()
+	}
+
+	return admitted <= idx.limit
+}
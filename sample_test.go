@@ -0,0 +1,161 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsSampled(t *testing.T) {
+
+	count := func(seed int64) (int, []bool) {
+
+		n := 0
+		sampled := make([]bool, 10000)
+
+		for i := 0; i < len(sampled); i++ {
+
+			sampled[i] = isSampled(fmt.Sprintf("/usr/local/data/%d.geojson", i), 0.1, seed)
+
+			if sampled[i] {
+				n += 1
+			}
+		}
+
+		return n, sampled
+	}
+
+	n, first := count(0)
+
+	if n < 900 || n > 1100 {
+		t.Fatalf("Expected roughly 10%% of records to be sampled, got %d", n)
+	}
+
+	_, again := count(0)
+	_, other := count(1)
+
+	same := true
+
+	for i := range first {
+
+		if first[i] != again[i] {
+			t.Fatalf("Expected sample to be deterministic")
+		}
+
+		if first[i] != other[i] {
+			same = false
+		}
+	}
+
+	if same {
+		t.Fatalf("Expected a different seed to produce a different sample")
+	}
+}
+
+func TestSampleAndLimit(t *testing.T) {
+
+	f := newTestFixture(t, "sample.db")
+
+	build := func(limit int64, rate float64) *RunStats {
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			Limit:      limit,
+			SampleRate: rate,
+			SampleSeed: 42,
+		})
+
+		err := idx.IndexURIs(f.ctx, "directory://", f.cwd)
+
+		if err != nil {
+			t.Fatalf("Failed to index records, %v", err)
+		}
+
+		return idx.Stats()
+	}
+
+	stats := build(2, 0)
+
+	if stats.Seen != 2 || stats.Indexed != 2 {
+		t.Fatalf("Expected limit to be applied, got %v", stats)
+	}
+
+	expected := int64(0)
+
+	filepath.WalkDir(f.cwd, func(path string, d fs.DirEntry, err error) error {
+
+		if err != nil || d.IsDir() {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(f.cwd, path)
+
+		if isSampled(filepath.ToSlash(rel), 0.5, 42) {
+			expected += 1
+		}
+
+		return nil
+	})
+
+	stats = build(0, 0.5)
+
+	if stats.Seen != expected {
+		t.Fatalf("Expected %d sampled records, got %d", expected, stats.Seen)
+	}
+
+	_, err := NewSQLiteIndexer(&SQLiteIndexerOptions{
+		SampleRate: 1.5,
+	})
+
+	if err == nil {
+		t.Fatalf("Expected invalid sample rate to fail")
+	}
+}
+
+func TestSamplePath(t *testing.T) {
+
+	a := samplePath(Source{URIs: []string{"/usr/local/data"}}, "/usr/local/data/101/736/545/101736545.geojson")
+	b := samplePath(Source{URIs: []string{"/tmp/checkout/data/"}}, "/tmp/checkout/data/101/736/545/101736545.geojson")
+
+	if a != "101/736/545/101736545.geojson" || a != b {
+		t.Fatalf("Expected paths relative to their sources, got '%s' and '%s'", a, b)
+	}
+
+	c := samplePath(Source{URIs: []string{"/usr/local/data"}}, "/usr/local/other/101736545.geojson")
+
+	if c != "/usr/local/other/101736545.geojson" {
+		t.Fatalf("Expected path outside source to be unchanged, got '%s'", c)
+	}
+}
+
+func TestLimitStopsIteration(t *testing.T) {
+
+	idx, err := NewSQLiteIndexer(&SQLiteIndexerOptions{
+		Limit: 2,
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to create sqlite indexer because %v", err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	run := &indexRun{sources: []Source{Source{URIs: []string{"/usr/local/data"}}}, stop: stop}
+
+	for i := 0; i < 2; i++ {
+
+		if !idx.admitRecord(run, 0, fmt.Sprintf("/usr/local/data/%d.geojson", i)) {
+			t.Fatalf("Expected record %d to be admitted", i)
+		}
+	}
+
+	if ctx.Err() == nil {
+		t.Fatalf("Expected iteration to be stopped once the limit was reached")
+	}
+
+	if idx.admitRecord(run, 0, "/usr/local/data/3.geojson") {
+		t.Fatalf("Expected record past the limit to be ignored")
+	}
+}
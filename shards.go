@@ -0,0 +1,541 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/tidwall/gjson"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_SHARD_SCHEME is the default `aaronland/go-sqlite` database scheme used to open shards.
+const DEFAULT_SHARD_SCHEME string = "modernc"
+
+// DEFAULT_SHARD_SIZE_INTERVAL is the default number of records written to a shard between checks of its size.
+const DEFAULT_SHARD_SIZE_INTERVAL int = 100
+
+// sqlite_uri_replacer percent-encodes the characters that have a special meaning in the path of a SQLite URI filename.
+var sqlite_uri_replacer = strings.NewReplacer("%", "%25", "?", "%3F", "#", "%23")
+
+// re_shard_key matches characters that are not allowed in the shard key portion of a shard's filename.
+var re_shard_key = regexp.MustCompile(`[^A-Za-z0-9_.\-]+`)
+
+// ShardKeyFunc is a custom function that returns the shard key for a record. Records with the same shard key are written
+// to the same shard (or series of shards if a maximum size has been set).
+type ShardKeyFunc func(context.Context, interface{}) (string, error)
+
+// NewPropertyShardKeyFunc returns a `ShardKeyFunc` that uses the value of the `tidwall/gjson` 'path' (for example
+// "properties.wof:country") as the shard key. Records are expected to be JSON-encoded byte slices, strings or anything
+// that can be marshaled as JSON. Records without a value for 'path' produce an error.
+func NewPropertyShardKeyFunc(path string) ShardKeyFunc {
+
+	return func(ctx context.Context, record interface{}) (string, error) {
+
+		body, err := recordBody(record)
+
+		if err != nil {
+			return "", err
+		}
+
+		rsp := gjson.GetBytes(body, path)
+
+		if !rsp.Exists() {
+			return "", fmt.Errorf("Missing %s property", path)
+		}
+
+		return rsp.String(), nil
+	}
+}
+
+// Sharding defines how the records for a `Target` are divided among multiple database files (shards). Shards are named
+// after `Path`: if there is a shard key it is appended to the filename and if there is a maximum size a sequence number
+// is appended to that. For example "foo-0001.db", "foo-0002.db" or "foo-US.db" or "foo-US-0001.db". Each of the target's
+// tables is initialized in every shard. Shards are recreated during each run, replacing any file with the same name written
+// by an earlier run, so that the manifest describes their entire contents. Shards from earlier runs that are not written to
+// are left in place but are not listed in the manifest.
+type Sharding struct {
+	// Path is the path that shard filenames are derived from. Relative paths are resolved against the current working
+	// directory at the start of each run.
+	Path string
+	// KeyFunc is an optional `ShardKeyFunc` function used to route each record to a shard.
+	KeyFunc ShardKeyFunc
+	// MaxSize is the optional size, in bytes, after which a new shard is started. The size of a shard is checked every
+	// `SizeInterval` records so shards may exceed `MaxSize` by the size of that many records.
+	MaxSize int64
+	// SizeInterval is the optional number of records written to a shard between checks of its size. If zero
+	// `DEFAULT_SHARD_SIZE_INTERVAL` is used.
+	SizeInterval int
+	// ManifestPath is the optional path of the JSON-encoded `ShardManifest` file written at the end of each successful
+	// run. If empty it is derived from `Path`, for example "foo-manifest.json". Relative paths are resolved against the
+	// current working directory at the start of each run.
+	ManifestPath string
+	// Scheme is the optional `aaronland/go-sqlite` database scheme used to open each shard. If empty `DEFAULT_SHARD_SCHEME`
+	// is used in which case the `aaronland/go-sqlite-modernc` package must be imported.
+	Scheme string
+}
+
+// ShardManifest is a struct describing the shards written to by a sharded `Target` during a run.
+type ShardManifest struct {
+	// Target is the name of the target.
+	Target string `json:"target"`
+	// RunID is the unique identifier of the run.
+	RunID string `json:"run_id"`
+	// Created is the time the manifest was written, formatted as RFC3339.
+	Created string `json:"created"`
+	// Shards is the list of shards, in the order they were opened.
+	Shards []*ShardInfo `json:"shards"`
+}
+
+// ShardInfo is a struct describing an individual shard.
+type ShardInfo struct {
+	// Path is the path of the shard.
+	Path string `json:"path"`
+	// ShardKey is the shard key for the records in the shard, if any.
+	ShardKey string `json:"shard_key,omitempty"`
+	// Sequence is the sequence number of the shard, if the target has a maximum size.
+	Sequence int `json:"sequence,omitempty"`
+	// Count is the number of records in the shard.
+	Count int64 `json:"count"`
+	// MinKey is the smallest record key in the shard. Keys that are integers are compared numerically.
+	MinKey string `json:"min_key,omitempty"`
+	// MaxKey is the largest record key in the shard.
+	MaxKey string `json:"max_key,omitempty"`
+	// Size is the size of the shard, in bytes, at the end of the run.
+	Size int64 `json:"size"`
+}
+
+// validate returns an error if 's' is not a valid sharding definition.
+func (s *Sharding) validate() error {
+
+	if s.Path == "" {
+		return fmt.Errorf("Missing path")
+	}
+
+	if s.KeyFunc == nil && s.MaxSize <= 0 {
+		return fmt.Errorf("Sharding requires a key function or a maximum size")
+	}
+
+	if s.MaxSize < 0 {
+		return fmt.Errorf("Maximum size must not be negative")
+	}
+
+	if s.SizeInterval < 0 {
+		return fmt.Errorf("Size interval must not be negative")
+	}
+
+	return nil
+}
+
+// shardPath returns the (absolute) path of the shard for 'key' and 'seq'.
+func (set *shardSet) shardPath(key string, seq int) string {
+
+	ext := filepath.Ext(set.path)
+	path := strings.TrimSuffix(set.path, ext)
+
+	if key != "" {
+		path = fmt.Sprintf("%s-%s", path, shardName(key))
+	}
+
+	if set.sharding.MaxSize > 0 {
+		path = fmt.Sprintf("%s-%04d", path, seq)
+	}
+
+	return path + ext
+}
+
+// sizeInterval returns the number of records written to a shard between checks of its size.
+func (s *Sharding) sizeInterval() int64 {
+
+	if s.SizeInterval > 0 {
+		return int64(s.SizeInterval)
+	}
+
+	return int64(DEFAULT_SHARD_SIZE_INTERVAL)
+}
+
+// shardName returns the shard key portion of the filename for the shards for 'key'.
+func shardName(key string) string {
+	return re_shard_key.ReplaceAllString(key, "_")
+}
+
+// manifestPath returns the (absolute) path of the manifest for 'set'.
+func (set *shardSet) manifestPath() string {
+
+	if set.manifest_path != "" {
+		return set.manifest_path
+	}
+
+	ext := filepath.Ext(set.path)
+	return fmt.Sprintf("%s-manifest.json", strings.TrimSuffix(set.path, ext))
+}
+
+// shardURI returns the `aaronland/go-sqlite` database URI, using 'scheme', for the shard at 'path'. Characters with a
+// special meaning in SQLite URI filenames are percent-encoded before the path is (percent-encoded again and) added to
+// the URI since it is decoded once when the URI is parsed and again when SQLite opens the resulting filename.
+func shardURI(scheme string, path string) string {
+
+	path = sqlite_uri_replacer.Replace(path)
+
+	u := &url.URL{
+		Scheme: scheme,
+		Path:   path,
+	}
+
+	return u.String()
+}
+
+// shard is a struct containing an open shard and the details needed to describe it in a manifest.
+type shard struct {
+	info *ShardInfo
+	db   sqlite.Database
+}
+
+// add updates the count and key range of 's' for a record with 'key'.
+func (s *shard) add(key string) {
+
+	s.info.Count += 1
+
+	if key == "" {
+		return
+	}
+
+	if s.info.MinKey == "" || compareKeys(key, s.info.MinKey) < 0 {
+		s.info.MinKey = key
+	}
+
+	if s.info.MaxKey == "" || compareKeys(key, s.info.MaxKey) > 0 {
+		s.info.MaxKey = key
+	}
+}
+
+// shardSet is a struct containing the shards opened for a sharded `Target` during a run. It is only accessed while
+// holding the target's write lock.
+type shardSet struct {
+	sharding *Sharding
+	tables   []sqlite.Table
+	// path is the absolute path that shard filenames are derived from.
+	path string
+	// manifest_path is the absolute path of the manifest. It is empty if it is derived from 'path'.
+	manifest_path string
+	// shards is the list of shards in the order they were opened.
+	shards []*shard
+	// current is a map of shard keys and the shard currently being written to for that key.
+	current map[string]*shard
+	// names is a map of the shard key portion of shard filenames and the shard key they were derived from.
+	names map[string]string
+}
+
+// newShardSet returns a new `shardSet` instance for 't', resolving any relative paths in its sharding definition against
+// the current working directory since shards are opened using database URIs which do not support them.
+func newShardSet(t *Target) (*shardSet, error) {
+
+	path, err := filepath.Abs(t.Sharding.Path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive absolute path for %s, %w", t.Sharding.Path, err)
+	}
+
+	s := &shardSet{
+		sharding: t.Sharding,
+		tables:   t.Tables,
+		path:     path,
+		shards:   make([]*shard, 0),
+		current:  make(map[string]*shard),
+		names:    make(map[string]string),
+	}
+
+	if t.Sharding.ManifestPath != "" {
+
+		manifest_path, err := filepath.Abs(t.Sharding.ManifestPath)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to derive absolute path for %s, %w", t.Sharding.ManifestPath, err)
+		}
+
+		s.manifest_path = manifest_path
+	}
+
+	return s, nil
+}
+
+// shardRecord returns the shard that 'lr' should be written to, opening a new shard if necessary.
+func (idx *SQLiteIndexer) shardRecord(ctx context.Context, run *indexRun, set *shardSet, lr *loadedRecord) (*shard, error) {
+
+	var key string
+
+	if set.sharding.KeyFunc != nil {
+
+		err := idx.safeCall(ctx, run, lr, "", func(ctx context.Context) error {
+			k, err := set.sharding.KeyFunc(ctx, lr.record)
+			key = k
+			return err
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to derive shard key, %w", err)
+		}
+
+		if key == "" {
+			return nil, fmt.Errorf("Empty shard key")
+		}
+	}
+
+	s, ok := set.current[key]
+
+	if !ok {
+
+		// Keys that differ only in characters that are not allowed in filenames would
+		// otherwise be written to the same shard
+
+		name := shardName(key)
+		other, exists := set.names[name]
+
+		if exists {
+			return nil, fmt.Errorf("Shard key '%s' has the same filename as shard key '%s'", key, other)
+		}
+
+		set.names[name] = key
+		return idx.openShard(ctx, run, set, key, 1)
+	}
+
+	// Shards always receive at least one record so that a maximum size smaller than an
+	// empty database does not cause a new shard for every record
+
+	if set.sharding.MaxSize == 0 || s.info.Count == 0 || s.info.Count%set.sharding.sizeInterval() != 0 {
+		return s, nil
+	}
+
+	size, err := databaseSize(ctx, s.db)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to determine size of %s, %w", s.info.Path, err)
+	}
+
+	if size < set.sharding.MaxSize {
+		return s, nil
+	}
+
+	run.logger.Info("Rolling over to new shard", "path", s.info.Path, "size", size)
+	return idx.openShard(ctx, run, set, key, s.info.Sequence+1)
+}
+
+// openShard creates the shard for 'key' and 'seq', removing any existing shard with the same path, initializes (and
+// records the schema version of) each of the tables in 'set' in it and makes it the current shard for 'key'.
+func (idx *SQLiteIndexer) openShard(ctx context.Context, run *indexRun, set *shardSet, key string, seq int) (*shard, error) {
+
+	path := set.shardPath(key, seq)
+
+	for _, p := range []string{path, path + "-journal", path + "-wal", path + "-shm"} {
+
+		err := os.Remove(p)
+
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Failed to remove existing shard %s, %w", p, err)
+		}
+	}
+
+	scheme := set.sharding.Scheme
+
+	if scheme == "" {
+		scheme = DEFAULT_SHARD_SCHEME
+	}
+
+	db, err := sqlite.NewDatabase(ctx, shardURI(scheme, path))
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open shard %s, %w", path, err)
+	}
+
+	for _, t := range set.tables {
+
+		err := t.InitializeTable(ctx, db)
+
+		if err != nil {
+			db.Close(ctx)
+			return nil, fmt.Errorf("Failed to initialize '%s' table in shard %s, %w", t.Name(), path, err)
+		}
+	}
+
+	err = idx.migrateTables(ctx, run, db, set.tables)
+
+	if err != nil {
+		db.Close(ctx)
+		return nil, fmt.Errorf("Failed to migrate tables in shard %s, %w", path, err)
+	}
+
+	info := &ShardInfo{
+		Path:     path,
+		ShardKey: key,
+	}
+
+	if set.sharding.MaxSize > 0 {
+		info.Sequence = seq
+	}
+
+	s := &shard{
+		info: info,
+		db:   db,
+	}
+
+	set.shards = append(set.shards, s)
+	set.current[key] = s
+
+	run.logger.Debug("Opened shard", "path", path)
+
+	return s, nil
+}
+
+// writeManifest writes a `ShardManifest` describing each of the shards in 'set' to its manifest path, via a temporary file.
+func (set *shardSet) writeManifest(ctx context.Context, run *indexRun, name string) error {
+
+	manifest := &ShardManifest{
+		Target:  name,
+		RunID:   run.id,
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Shards:  make([]*ShardInfo, len(set.shards)),
+	}
+
+	for i, s := range set.shards {
+
+		size, err := databaseSize(ctx, s.db)
+
+		if err != nil {
+			return fmt.Errorf("Failed to determine size of %s, %w", s.info.Path, err)
+		}
+
+		info := *s.info
+		info.Size = size
+
+		manifest.Shards[i] = &info
+	}
+
+	body, err := json.MarshalIndent(manifest, "", "  ")
+
+	if err != nil {
+		return fmt.Errorf("Failed to marshal manifest, %w", err)
+	}
+
+	path := set.manifestPath()
+	tmp_path := fmt.Sprintf("%s.tmp", path)
+
+	err = os.WriteFile(tmp_path, body, 0644)
+
+	if err != nil {
+		return fmt.Errorf("Failed to write %s, %w", tmp_path, err)
+	}
+
+	err = os.Rename(tmp_path, path)
+
+	if err != nil {
+		os.Remove(tmp_path)
+		return fmt.Errorf("Failed to rename %s, %w", tmp_path, err)
+	}
+
+	return nil
+}
+
+// close closes each of the shards in 'set'.
+func (set *shardSet) close(ctx context.Context) error {
+
+	for _, s := range set.shards {
+
+		err := s.db.Close(ctx)
+
+		if err != nil {
+			return fmt.Errorf("Failed to close shard %s, %w", s.info.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// writeShardManifests writes the manifest for each of the sharded targets in 'run'.
+func (idx *SQLiteIndexer) writeShardManifests(ctx context.Context, run *indexRun) error {
+
+	for _, state := range run.targets {
+
+		if state.shards == nil {
+			continue
+		}
+
+		err := state.shards.writeManifest(ctx, run, state.target.Name)
+
+		if err != nil {
+			return fmt.Errorf("Failed to write manifest for '%s' target, %w", state.target.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// closeShards closes the shards opened by each of the sharded targets in 'run'.
+func (idx *SQLiteIndexer) closeShards(ctx context.Context, run *indexRun) {
+
+	for _, state := range run.targets {
+
+		if state.shards == nil {
+			continue
+		}
+
+		err := state.shards.close(ctx)
+
+		if err != nil {
+			run.logger.Error("Failed to close shards", "target", state.target.Name, "error", err)
+		}
+	}
+}
+
+// databaseSize returns the size, in bytes, of the main database in 'db'.
+func databaseSize(ctx context.Context, db sqlite.Database) (int64, error) {
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return 0, fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	var page_count int64
+	var page_size int64
+
+	err = conn.QueryRowContext(ctx, "PRAGMA page_count").Scan(&page_count)
+
+	if err != nil {
+		return 0, fmt.Errorf("Failed to determine page count, %w", err)
+	}
+
+	err = conn.QueryRowContext(ctx, "PRAGMA page_size").Scan(&page_size)
+
+	if err != nil {
+		return 0, fmt.Errorf("Failed to determine page size, %w", err)
+	}
+
+	return page_count * page_size, nil
+}
+
+// compareKeys compares 'a' and 'b' numerically, if they are both integers, and otherwise lexically.
+func compareKeys(a string, b string) int {
+
+	int_a, err_a := strconv.ParseInt(a, 10, 64)
+	int_b, err_b := strconv.ParseInt(b, 10, 64)
+
+	if err_a == nil && err_b == nil {
+
+		switch {
+		case int_a < int_b:
+			return -1
+		case int_a > int_b:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return strings.Compare(a, b)
+}
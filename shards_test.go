@@ -0,0 +1,242 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/aaronland/go-sqlite/v2/tables"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShards(t *testing.T) {
+
+	f := newTestFixture(t, "shards.db")
+
+	root := f.tmpdir
+
+	shard_t, err := tables.NewExampleTable(f.ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to create example table, %v", err)
+	}
+
+	shard_key_func := func(ctx context.Context, record interface{}) (string, error) {
+
+		path, err := pathKey(record)
+
+		if err != nil {
+			return "", err
+		}
+
+		if strings.HasSuffix(path, "_test.go") {
+			return "test", nil
+		}
+
+		return "src", nil
+	}
+
+	build := func(sharding *Sharding) *ShardManifest {
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			LoadRecordFunc: pathRecord,
+			KeyFunc:        pathKey,
+			Targets: []*Target{
+				&Target{Name: "shards", Sharding: sharding, Tables: []sqlite.Table{shard_t}},
+			},
+		})
+
+		err := idx.IndexURIs(f.ctx, "directory://", f.path("config"), f.path("cmd"))
+
+		if err != nil {
+			t.Fatalf("Failed to index URIs, %v", err)
+		}
+
+		set, err := newShardSet(&Target{Sharding: sharding})
+
+		if err != nil {
+			t.Fatalf("Failed to create shard set, %v", err)
+		}
+
+		body, err := os.ReadFile(set.manifestPath())
+
+		if err != nil {
+			t.Fatalf("Failed to read manifest, %v", err)
+		}
+
+		var manifest *ShardManifest
+
+		err = json.Unmarshal(body, &manifest)
+
+		if err != nil {
+			t.Fatalf("Failed to unmarshal manifest, %v", err)
+		}
+
+		return manifest
+	}
+
+	keyed := &Sharding{
+		Path:    filepath.Join(root, "keyed.db"),
+		KeyFunc: shard_key_func,
+	}
+
+	// Shards written to by an earlier run are recreated so the manifest describes their entire contents
+
+	var manifest *ShardManifest
+	counts := make(map[string]*ShardInfo)
+
+	for run := 1; run <= 2; run++ {
+
+		manifest = build(keyed)
+
+		for _, info := range manifest.Shards {
+			counts[filepath.Base(info.Path)] = info
+		}
+
+		if len(counts) != 2 || counts["keyed-src.db"].Count != 2 || counts["keyed-test.db"].Count != 1 {
+			t.Fatalf("Unexpected shards for run %d, %v", run, counts)
+		}
+	}
+
+	if f.count(t, f.openDatabase(t, "keyed-src.db"), "SELECT COUNT(*) FROM example") != 2 {
+		t.Fatalf("Expected src shard to contain only the records from the last run")
+	}
+
+	src := counts["keyed-src.db"]
+
+	if src.MinKey != f.path("cmd", "example", "main.go") || src.MaxKey != f.path("config", "config.go") {
+		t.Fatalf("Unexpected key range for src shard, %s - %s", src.MinKey, src.MaxKey)
+	}
+
+	// Every shard exceeds a maximum size of 1 byte as soon as it has been created so, if its size
+	// is checked after every record, each record is written to a new shard
+
+	sized := &Sharding{
+		Path:         filepath.Join(root, "sized.db"),
+		MaxSize:      1,
+		SizeInterval: 1,
+	}
+
+	for run := 1; run <= 2; run++ {
+
+		manifest = build(sized)
+
+		if len(manifest.Shards) != 3 {
+			t.Fatalf("Expected 3 shards for run %d, got %d", run, len(manifest.Shards))
+		}
+
+		for i, info := range manifest.Shards {
+
+			expected := filepath.Join(root, fmt.Sprintf("sized-%04d.db", i+1))
+
+			if info.Path != expected || info.Sequence != i+1 || info.Count != 1 {
+				t.Fatalf("Unexpected shard for run %d, %v", run, info)
+			}
+		}
+	}
+
+	// Characters with a special meaning in database URIs are escaped
+
+	escaped := &Sharding{
+		Path:    filepath.Join(root, "escaped?mode=ro#1.db"),
+		MaxSize: 1 << 30,
+	}
+
+	manifest = build(escaped)
+	expected := filepath.Join(root, "escaped?mode=ro#1-0001.db")
+
+	if len(manifest.Shards) != 1 || manifest.Shards[0].Path != expected || manifest.Shards[0].Count != 3 {
+		t.Fatalf("Unexpected shards for path with escaped characters, %v", manifest.Shards)
+	}
+
+	_, err = os.Stat(expected)
+
+	if err != nil {
+		t.Fatalf("Expected shard to be written to %s, %v", expected, err)
+	}
+
+	_, err = NewSQLiteIndexer(&SQLiteIndexerOptions{
+		Targets: []*Target{
+			&Target{Name: "shards", Sharding: &Sharding{Path: sized.Path}, Tables: []sqlite.Table{shard_t}},
+		},
+	})
+
+	if err == nil {
+		t.Fatalf("Expected sharding without a key function or maximum size to fail")
+	}
+
+	// Shard keys whose filenames are the same can not be used during the same run
+
+	colliding_func := func(ctx context.Context, record interface{}) (string, error) {
+
+		path, err := pathKey(record)
+
+		if err != nil {
+			return "", err
+		}
+
+		if strings.HasSuffix(path, "_test.go") {
+			return "a b", nil
+		}
+
+		return "a_b", nil
+	}
+
+	idx := f.indexer(t, &SQLiteIndexerOptions{
+		LoadRecordFunc: pathRecord,
+		KeyFunc:        pathKey,
+		Targets: []*Target{
+			&Target{Name: "shards", Sharding: &Sharding{Path: filepath.Join(root, "colliding.db"), KeyFunc: colliding_func}, Tables: []sqlite.Table{shard_t}},
+		},
+	})
+
+	err = idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	if err == nil || !strings.Contains(err.Error(), "same filename") {
+		t.Fatalf("Expected colliding shard keys to fail, got %v", err)
+	}
+}
+
+func TestShardingRelativePath(t *testing.T) {
+
+	cwd, err := os.Getwd()
+
+	if err != nil {
+		t.Fatalf("Failed to get current working directory, %v", err)
+	}
+
+	sharding := &Sharding{
+		Path:         filepath.Join("data", "foo.db"),
+		ManifestPath: "manifest.json",
+		MaxSize:      1,
+	}
+
+	err = sharding.validate()
+
+	if err != nil {
+		t.Fatalf("Failed to validate sharding, %v", err)
+	}
+
+	set, err := newShardSet(&Target{Sharding: sharding})
+
+	if err != nil {
+		t.Fatalf("Failed to create shard set, %v", err)
+	}
+
+	if set.shardPath("", 1) != filepath.Join(cwd, "data", "foo-0001.db") {
+		t.Fatalf("Expected shard path relative to the current working directory, got %s", set.shardPath("", 1))
+	}
+
+	if set.manifestPath() != filepath.Join(cwd, "manifest.json") {
+		t.Fatalf("Expected manifest path relative to the current working directory, got %s", set.manifestPath())
+	}
+
+	// The caller's sharding definition is left as-is
+
+	if sharding.Path != filepath.Join("data", "foo.db") || sharding.ManifestPath != "manifest.json" {
+		t.Fatalf("Expected sharding paths not to be modified, got %s %s", sharding.Path, sharding.ManifestPath)
+	}
+}
@@ -0,0 +1,579 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/whosonfirst/go-whosonfirst-iterate/v2/emitter"
+	"github.com/whosonfirst/go-whosonfirst-iterate/v2/iterator"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Source defines a `whosonfirst/go-whosonfirst-iterate/v2` iterator URI and the URIs it should process.
+type Source struct {
+	// IteratorURI is a valid `whosonfirst/go-whosonfirst-iterate/v2` URI.
+	IteratorURI string
+	// URIs is the list of URIs to be processed by the iterator defined by `IteratorURI`.
+	URIs []string
+}
+
+// indexRun is a struct containing state scoped to a single invocation of the `IndexSources` method.
+type indexRun struct {
+	// id is the unique identifier for the run.
+	id string
+	// started is the time the run started.
+	started time.Time
+	// logger is the indexer's logger with the run's ID attached.
+	logger  *slog.Logger
+	sources []Source
+	// admitted is the number of records admitted for processing. It is only incremented if the indexer has a limit.
+	admitted int64
+	// stop cancels the context used to iterate the run's sources. It is called once the indexer's limit has been reached.
+	stop context.CancelFunc
+	// total is the total number of records to process during the run. It is zero unless sources were pre-scanned.
+	total int64
+	// counts is the tally of records processed during the run.
+	counts *runCounts
+	// failures is the tally of per-table failures (for tables that are not required) during the run.
+	failures *tableFailures
+	// seen_paths is used to skip records whose path has already been processed. It is nil if there is only one source.
+	seen_paths *sync.Map
+	// claims is used to resolve records with duplicate keys. It is nil unless a precedence policy has been set.
+	claims *claims
+	// buffer is used to hold loaded records until they are written in sorted order. It is nil unless the indexer is reproducible.
+	buffer *recordBuffer
+	// slow_records is the list of records that exceeded the indexer's slow record threshold during the run. It is nil unless a threshold has been set.
+	slow_records *slowRecords
+	// targets is the state for each of the indexer's targets during the run. It is empty unless the indexer has targets and the run is not a dry run.
+	targets []*targetState
+	// errors is the list of errors for individual records encountered during the run. It is nil unless the run is a dry run.
+	errors *recordErrors
+	// record_errs is the first error returned while processing an individual record, for each source (by offset), during the run.
+	record_errs map[int]error
+	// record_errs_mu guards 'record_errs'.
+	record_errs_mu sync.Mutex
+	// deferred_indexes is the list of statements used to create the indexes that were dropped before indexing. It is
+	// empty unless the FINALIZE_CREATE_INDEXES step is enabled and those indexes have not been created again yet.
+	deferred_indexes []string
+	// target_timings is the list of timings for the finalization of the tables of each of the targets, which are
+	// finalized before the indexer's database.
+	target_timings []*FinalizeTiming
+}
+
+// setRecordError stores 'err' as the error that stopped the source at offset 'source' in 'run' unless an error has
+// already been stored for that source.
+func (run *indexRun) setRecordError(source int, err error) {
+
+	run.record_errs_mu.Lock()
+	defer run.record_errs_mu.Unlock()
+
+	if run.record_errs == nil {
+		run.record_errs = make(map[int]error)
+	}
+
+	_, ok := run.record_errs[source]
+
+	if !ok {
+		run.record_errs[source] = err
+	}
+}
+
+// sourceError returns the error to report when the iterator for the source at offset 'source' fails with 'err'. The
+// errors returned by iterators do not wrap the errors returned by their callbacks so, if a record error has been stored
+// for that source, it is returned instead in order that callers can inspect it using `errors.Is` and `errors.As`.
+func (run *indexRun) sourceError(source int, err error) error {
+
+	run.record_errs_mu.Lock()
+	defer run.record_errs_mu.Unlock()
+
+	record_err, ok := run.record_errs[source]
+
+	if ok {
+		return record_err
+	}
+
+	return err
+}
+
+// IndexSources will index records returned by the `whosonfirst/go-whosonfirst-iterate` instances for each
+// of 'sources' in to the same database. Sources are processed in order unless the `ConcurrentSources` flag is
+// true and the first error encountered by any source stops the run. Timings are reported for the run as a whole.
+//
+// Before any records are indexed the pragma profile, if present, is applied, tables are truncated or recreated
+// according to their table mode and tables that implement the `VersionedTable` interface are checked (and if
+// necessary migrated). The tables for any targets are initialized in their databases. Profiles are reverted, where
+// appropriate, when the run completes.
+//
+// When there is more than one source records whose path has already been processed by an earlier source are
+// skipped. If a precedence policy has been set records with duplicate keys are resolved according to that policy
+// and reported by the `Conflicts` method. If the indexer is reproducible records are written, sorted by key, only
+// after every source has been iterated and the database is vacuumed afterwards. Records are written to targets in
+// the same order they are written to the database and any records still queued for a target are written once every
+// source has been iterated. A manifest is then written for each sharded target.
+//
+// If runs are being recorded a row describing the run, and any error that stopped it, is written to the
+// `_index_runs` table once all the records have been indexed. Then any finalizable tables, and then any
+// finalization steps, are run. If a swap path has been set the database is copied to that path, atomically,
+// once everything else has succeeded. If finalization or the swap fails the recorded row is updated with that
+// error. Runs are only recorded in the indexer's own database, not in the databases (or shards) of its targets.
+//
+// During a dry run none of the steps that touch the database are performed, errors for individual records are
+// collected (and reported by the `Errors` method) rather than stopping the run and records are only indexed if
+// a dry run database has been defined.
+func (idx *SQLiteIndexer) IndexSources(ctx context.Context, sources []Source) error {
+
+	run_id := uuid.NewString()
+
+	run := &indexRun{
+		id:       run_id,
+		logger:   idx.logger().With("run_id", run_id),
+		started:  time.Now(),
+		sources:  sources,
+		counts:   new(runCounts),
+		failures: newTableFailures(),
+	}
+
+	defer idx.reportTableFailures(run)
+	defer idx.reportRetries(run)
+	defer idx.reportStats(run)
+
+	if idx.slow_record_threshold > 0 {
+		run.slow_records = newSlowRecords()
+		defer idx.reportSlowRecords(run)
+	}
+
+	if len(sources) > 1 {
+		run.seen_paths = new(sync.Map)
+	}
+
+	if idx.precedence != "" {
+		run.claims = newClaims(idx.precedence, sources)
+		defer idx.reportConflicts(run)
+	}
+
+	if idx.dry_run {
+		return idx.dryRun(ctx, run)
+	}
+
+	if len(idx.targets) > 0 {
+
+		states, err := idx.newTargetStates()
+
+		if err != nil {
+			return err
+		}
+
+		run.targets = states
+		defer idx.reportTargetStats(run)
+		defer idx.closeShards(ctx, run)
+	}
+
+	if idx.pragma_profile != "" {
+
+		revert_func, err := idx.applyPragmaProfile(ctx, idx.pragma_profile)
+
+		if err != nil {
+			return &DatabaseError{Op: fmt.Sprintf("apply '%s' pragma profile", idx.pragma_profile), Err: err}
+		}
+
+		defer func() {
+
+			err := revert_func(ctx)
+
+			if err != nil {
+				run.logger.Error("Failed to revert pragma profile", "profile", idx.pragma_profile, "error", err)
+			}
+		}()
+	}
+
+	defer idx.restoreIndexes(ctx, run)
+
+	err := idx.indexSources(ctx, run)
+
+	if idx.record_runs {
+
+		record_err := idx.recordRun(ctx, run, err)
+
+		if record_err != nil {
+
+			if err != nil {
+				run.logger.Error("Failed to record run", "error", record_err)
+			} else {
+				return &DatabaseError{Op: "record run", Err: record_err}
+			}
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = idx.completeRun(ctx, run)
+
+	if err != nil {
+
+		// The run was recorded before finalization so that the row is included in the
+		// finalized (and swapped) database; update it to reflect the error that stopped the run
+
+		if idx.record_runs {
+
+			record_err := idx.recordRun(ctx, run, err)
+
+			if record_err != nil {
+				run.logger.Error("Failed to record run", "error", record_err)
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// completeRun finalizes the indexer's database for 'run' and, if a swap path has been set, copies it to that path.
+func (idx *SQLiteIndexer) completeRun(ctx context.Context, run *indexRun) error {
+
+	err := idx.finalize(ctx, run)
+
+	if err != nil {
+		return &DatabaseError{Op: "finalize run", Err: err}
+	}
+
+	if idx.swap_path != "" {
+
+		err = idx.swapDatabase(ctx)
+
+		if err != nil {
+			return &DatabaseError{Op: fmt.Sprintf("swap database in to %s", idx.swap_path), Err: err}
+		}
+	}
+
+	return nil
+}
+
+// indexSources prepares (and if necessary migrates) the indexer's tables, and provenance table if necessary, and then
+// processes each of the sources in 'run'.
+func (idx *SQLiteIndexer) indexSources(ctx context.Context, run *indexRun) error {
+
+	err := idx.prepareTables(ctx, idx.db, idx.tables)
+
+	if err != nil {
+		return &DatabaseError{Op: "prepare tables", Err: err}
+	}
+
+	err = idx.migrateTables(ctx, run, idx.db, idx.tables)
+
+	if err != nil {
+		return &DatabaseError{Op: "migrate tables", Err: err}
+	}
+
+	if idx.hasFinalizeStep(FINALIZE_CREATE_INDEXES) {
+
+		err := idx.deferIndexes(ctx, run)
+
+		if err != nil {
+			return &DatabaseError{Op: "defer indexes", Err: err}
+		}
+	}
+
+	if idx.track_provenance {
+
+		err := idx.ensureProvenanceTable(ctx)
+
+		if err != nil {
+			return &DatabaseError{Op: "prepare provenance table", Err: err}
+		}
+	}
+
+	if len(run.targets) > 0 {
+
+		err := idx.initializeTargets(ctx, run)
+
+		if err != nil {
+			return &DatabaseError{Op: "initialize targets", Err: err}
+		}
+	}
+
+	if idx.reproducible {
+
+		err := idx.applyReproduciblePragmas(ctx)
+
+		if err != nil {
+			return &DatabaseError{Op: "apply pragmas for reproducible build", Err: err}
+		}
+
+		run.buffer = newRecordBuffer()
+	}
+
+	return idx.processSources(ctx, run)
+}
+
+// processSources iterates each of the sources in 'run', reporting progress and timings if necessary, and then writes
+// any buffered records.
+func (idx *SQLiteIndexer) processSources(ctx context.Context, run *indexRun) error {
+
+	sources := run.sources
+	iterators := make([]*iterator.Iterator, len(sources))
+
+	if idx.pre_scan {
+
+		total, err := idx.countSources(ctx, sources)
+
+		if err != nil {
+			run.logger.Warn("Failed to count records, only the rate will be reported", "error", err)
+		} else {
+			run.total = total
+			run.logger.Info("Counted records", "total", total)
+		}
+	}
+
+	if idx.progress_func != nil {
+
+		progress_ch := make(chan bool)
+		reported_ch := make(chan bool)
+
+		go func() {
+			idx.reportProgress(ctx, run, progress_ch)
+			close(reported_ch)
+		}()
+
+		defer func() {
+			close(progress_ch)
+			<-reported_ch
+		}()
+	}
+
+	// Records are processed using 'ctx' but the sources are iterated using a context that is cancelled once the
+	// indexer's limit has been reached so that records which are already being processed are unaffected.
+
+	iter_ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	run.stop = stop
+
+	for i, src := range sources {
+
+		cb := idx.iteratorCallback(ctx, run, i)
+
+		iter, err := iterator.NewIterator(iter_ctx, src.IteratorURI, cb)
+
+		if err != nil {
+			return fmt.Errorf("Failed to create new iterator for %s, %w", src.IteratorURI, err)
+		}
+
+		iterators[i] = iter
+	}
+
+	done_ch := make(chan bool)
+	t1 := time.Now()
+
+	// ideally this could be a proper stand-along package method but then
+	// we have to set up a whole bunch of scaffolding just to pass 'indexer'
+	// around so... we're not doing that (20180205/thisisaaronland)
+
+	show_timings := func() {
+
+		t2 := time.Since(t1)
+
+		i := int64(0)
+
+		for _, iter := range iterators {
+			i += atomic.LoadInt64(&iter.Seen)
+		}
+
+		idx.mu.RLock()
+		defer idx.mu.RUnlock()
+
+		for t, d := range idx.table_timings {
+			run.logger.Info("Time to index table", "table", t, "count", i, "duration", d)
+		}
+
+		run.logger.Info("Time to index all", "count", i, "duration", t2)
+	}
+
+	if idx.Timings {
+
+		go func() {
+
+			for {
+
+				select {
+				case <-done_ch:
+					return
+				case <-time.After(1 * time.Minute):
+					show_timings()
+				}
+			}
+		}()
+
+		defer func() {
+			done_ch <- true
+		}()
+	}
+
+	var err error
+
+	if idx.ConcurrentSources {
+		err = idx.iterateSourcesConcurrently(iter_ctx, run, iterators)
+	} else {
+		err = idx.iterateSources(iter_ctx, run, iterators)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if run.buffer != nil {
+
+		err = idx.flushRecords(ctx, run)
+
+		if err != nil {
+			return fmt.Errorf("Failed to write sorted records, %w", err)
+		}
+	}
+
+	if len(run.targets) > 0 {
+
+		err = idx.flushTargets(ctx, run)
+
+		if err != nil {
+			return err
+		}
+
+		err = idx.finalizeTargets(ctx, run)
+
+		if err != nil {
+			return &DatabaseError{Op: "finalize targets", Err: err}
+		}
+
+		err = idx.writeShardManifests(ctx, run)
+
+		if err != nil {
+			return &DatabaseError{Op: "write shard manifests", Err: err}
+		}
+	}
+
+	return nil
+}
+
+// iterateSources processes each of the sources in 'run', in order, using its corresponding iterator in 'iterators'
+// returning the first error encountered.
+func (idx *SQLiteIndexer) iterateSources(ctx context.Context, run *indexRun, iterators []*iterator.Iterator) error {
+
+	for i, src := range run.sources {
+
+		err := iterators[i].IterateURIs(ctx, src.URIs...)
+
+		if err != nil {
+			return fmt.Errorf("Failed to index %s source, %w", src.IteratorURI, run.sourceError(i, err))
+		}
+	}
+
+	return nil
+}
+
+// iterateSourcesConcurrently processes each of the sources in 'run' using its corresponding iterator in 'iterators'
+// at the same time, cancelling the remaining sources and returning the first error encountered.
+func (idx *SQLiteIndexer) iterateSourcesConcurrently(ctx context.Context, run *indexRun, iterators []*iterator.Iterator) error {
+
+	sources := run.sources
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wg := new(sync.WaitGroup)
+	err_ch := make(chan error, len(sources))
+
+	for i, src := range sources {
+
+		wg.Add(1)
+
+		go func(i int, iter *iterator.Iterator, src Source) {
+
+			defer wg.Done()
+
+			err := iter.IterateURIs(ctx, src.URIs...)
+
+			if err != nil {
+				err_ch <- fmt.Errorf("Failed to index %s source, %w", src.IteratorURI, run.sourceError(i, err))
+				cancel()
+			}
+
+		}(i, iterators[i], src)
+	}
+
+	wg.Wait()
+	close(err_ch)
+
+	return <-err_ch
+}
+
+// iteratorCallback returns a `emitter.EmitterCallbackFunc` that dispatches records produced by the source at
+// offset 'source' in 'run' to the indexer's `indexRecord` method, using 'ctx', skipping records whose path has already
+// been processed during the run.
+func (idx *SQLiteIndexer) iteratorCallback(ctx context.Context, run *indexRun, source int) emitter.EmitterCallbackFunc {
+
+	return func(_ context.Context, path string, r io.ReadSeeker, args ...interface{}) error {
+
+		if !idx.admitRecord(run, source, path) {
+			return nil
+		}
+
+		atomic.AddInt64(&run.counts.seen, 1)
+
+		if run.seen_paths != nil && path != emitter.STDIN {
+
+			_, loaded := run.seen_paths.LoadOrStore(path, true)
+
+			if loaded {
+				run.logger.Warn("Skipped record with duplicate path", "path", path)
+				atomic.AddInt64(&run.counts.skipped, 1)
+				return nil
+			}
+		}
+
+		err := idx.indexRecord(ctx, run, source, path, r, args...)
+
+		if err != nil {
+
+			// Records that could not be written to a target have already been counted in the
+			// run's statistics (and as failures in the target's)
+
+			var target_err *TargetError
+
+			if !errors.As(err, &target_err) {
+				atomic.AddInt64(&run.counts.failed, 1)
+			}
+
+			if run.errors != nil {
+				run.errors.Add(err)
+				return nil
+			}
+
+			run.setRecordError(source, err)
+			return err
+		}
+
+		return nil
+	}
+}
+
+// reportConflicts stores the conflicts recorded during 'run' so they can be retrieved by the `Conflicts` method
+// and logs how many there were.
+func (idx *SQLiteIndexer) reportConflicts(run *indexRun) {
+
+	conflicts := run.claims.Conflicts()
+
+	idx.mu.Lock()
+	idx.conflicts = conflicts
+	idx.mu.Unlock()
+
+	if len(conflicts) > 0 {
+		run.logger.Info("Resolved duplicate records", "count", len(conflicts), "precedence", idx.precedence)
+	}
+}
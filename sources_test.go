@@ -0,0 +1,83 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIndexSources(t *testing.T) {
+
+	f := newTestFixture(t, "sources.db")
+
+	for _, concurrent := range []bool{false, true} {
+
+		count := int64(0)
+
+		record_func := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+			atomic.AddInt64(&count, 1)
+			return exampleRecord(ctx, path, r, args...)
+		}
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			LoadRecordFunc: record_func,
+		})
+
+		idx.ConcurrentSources = concurrent
+
+		err := idx.IndexURIs(f.ctx, "directory://", f.cwd)
+
+		if err != nil {
+			t.Fatalf("Failed to index URIs, %v", err)
+		}
+
+		expected := atomic.LoadInt64(&count)
+		atomic.StoreInt64(&count, 0)
+
+		sources := []Source{
+			Source{IteratorURI: "directory://", URIs: []string{f.cwd}},
+			Source{IteratorURI: "directory://", URIs: []string{f.cwd}},
+		}
+
+		err = idx.IndexSources(f.ctx, sources)
+
+		if err != nil {
+			t.Fatalf("Failed to index sources, %v", err)
+		}
+
+		if atomic.LoadInt64(&count) != expected {
+			t.Fatalf("Expected duplicate paths to be skipped (concurrent: %t): %d != %d", concurrent, count, expected)
+		}
+
+		sources = append(sources, Source{IteratorURI: "bogus://"})
+
+		err = idx.IndexSources(f.ctx, sources)
+
+		if err == nil {
+			t.Fatalf("Expected invalid iterator URI to fail")
+		}
+	}
+}
+
+func TestSourceError(t *testing.T) {
+
+	run := &indexRun{}
+
+	first := fmt.Errorf("First record error")
+	second := fmt.Errorf("Second record error")
+	iter_err := fmt.Errorf("Iterator error")
+
+	run.setRecordError(0, first)
+	run.setRecordError(0, second)
+
+	if !errors.Is(run.sourceError(0, iter_err), first) {
+		t.Fatalf("Expected first record error to be reported for source")
+	}
+
+	if !errors.Is(run.sourceError(1, iter_err), iter_err) {
+		t.Fatalf("Expected iterator error to be reported for source without a record error")
+	}
+}
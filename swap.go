@@ -0,0 +1,186 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// swapDatabase copies the indexer's database, using `VACUUM INTO`, to a temporary file alongside the indexer's
+// swap path, optionally runs an integrity check against that copy and then atomically renames it to the swap path.
+// If any step fails the temporary file is removed and the file at the swap path is left untouched.
+func (idx *SQLiteIndexer) swapDatabase(ctx context.Context) error {
+
+	target, err := filepath.Abs(idx.swap_path)
+
+	if err != nil {
+		return fmt.Errorf("Failed to derive absolute path for %s, %w", idx.swap_path, err)
+	}
+
+	fh, err := os.CreateTemp(filepath.Dir(target), fmt.Sprintf(".%s-*.tmp", filepath.Base(target)))
+
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary file for %s, %w", target, err)
+	}
+
+	tmp_path := fh.Name()
+
+	fh.Close()
+
+	// VACUUM INTO will only write to a file that does not exist (or is empty)
+	// so remove the placeholder now and clean up after ourselves if anything fails
+
+	err = os.Remove(tmp_path)
+
+	if err != nil {
+		return fmt.Errorf("Failed to remove temporary file %s, %w", tmp_path, err)
+	}
+
+	swapped := false
+
+	defer func() {
+
+		if !swapped {
+			os.Remove(tmp_path)
+		}
+	}()
+
+	db_conn, err := idx.db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	idx.db.Lock(ctx)
+	defer idx.db.Unlock(ctx)
+
+	// ATTACH statements are scoped to a single connection so make sure everything
+	// happens on the same one rather than whatever the connection pool hands us
+
+	conn, err := db_conn.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "VACUUM INTO ?", tmp_path)
+
+	if err != nil {
+		return fmt.Errorf("Failed to copy database to %s, %w", tmp_path, err)
+	}
+
+	if idx.swap_integrity_check {
+
+		_, err = conn.ExecContext(ctx, "ATTACH DATABASE ? AS swap_check", tmp_path)
+
+		if err != nil {
+			return fmt.Errorf("Failed to attach %s, %w", tmp_path, err)
+		}
+
+		check_err := checkIntegrity(ctx, conn, "swap_check")
+
+		_, err = conn.ExecContext(ctx, "DETACH DATABASE swap_check")
+
+		if err != nil {
+			return fmt.Errorf("Failed to detach %s, %w", tmp_path, err)
+		}
+
+		if check_err != nil {
+			return fmt.Errorf("Integrity check failed for %s, %w", tmp_path, check_err)
+		}
+	}
+
+	// The copy is written with whatever synchronous setting is in effect for the run (for example
+	// the bulk-load pragma profile, which is not reverted until after the swap) so make sure it has
+	// been flushed to disk before it replaces the file at the swap path
+
+	err = syncPath(tmp_path)
+
+	if err != nil {
+		return fmt.Errorf("Failed to sync %s, %w", tmp_path, err)
+	}
+
+	err = os.Rename(tmp_path, target)
+
+	if err != nil {
+		return fmt.Errorf("Failed to rename %s to %s, %w", tmp_path, target, err)
+	}
+
+	swapped = true
+
+	err = syncPath(filepath.Dir(target))
+
+	if err != nil {
+		return fmt.Errorf("Failed to sync %s, %w", filepath.Dir(target), err)
+	}
+
+	return nil
+}
+
+// syncPath commits the contents of the file, or directory, at 'path' to stable storage.
+func syncPath(path string) error {
+
+	fh, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer fh.Close()
+
+	return fh.Sync()
+}
+
+// queryContext is the subset of methods shared by `sql.DB` and `sql.Conn` needed to run an integrity check.
+type queryContext interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}
+
+// checkIntegrity runs `PRAGMA integrity_check` against the database named 'schema' (for example "main") and returns an
+// error listing any problems that were reported.
+func checkIntegrity(ctx context.Context, conn queryContext, schema string) error {
+
+	q := fmt.Sprintf("PRAGMA %s.INTEGRITY_CHECK", schema)
+
+	rows, err := conn.QueryContext(ctx, q)
+
+	if err != nil {
+		return fmt.Errorf("Failed to run integrity check, %w", err)
+	}
+
+	defer rows.Close()
+
+	problems := make([]string, 0)
+
+	for rows.Next() {
+
+		var result string
+
+		err := rows.Scan(&result)
+
+		if err != nil {
+			return fmt.Errorf("Failed to scan integrity check result, %w", err)
+		}
+
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return fmt.Errorf("Failed to iterate integrity check results, %w", err)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/aaronland/go-sqlite/v2/tables"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwapDatabase(t *testing.T) {
+
+	f := newTestFixture(t, "swap.db")
+
+	target := filepath.Join(f.tmpdir, "published.db")
+
+	err := os.WriteFile(target, []byte("previous"), 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write %s, %v", target, err)
+	}
+
+	build := func(fail bool) error {
+
+		db := f.openDatabase(t, fmt.Sprintf("build-%t.db", fail))
+
+		ex_t, err := tables.NewExampleTableWithDatabase(f.ctx, db)
+
+		if err != nil {
+			t.Fatalf("Failed to create example table, %v", err)
+		}
+
+		record_func := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+
+			if fail {
+				return nil, fmt.Errorf("Intentional failure")
+			}
+
+			return exampleRecord(ctx, path, r, args...)
+		}
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			DB:                 db,
+			Tables:             []sqlite.Table{ex_t},
+			LoadRecordFunc:     record_func,
+			SwapPath:           target,
+			SwapIntegrityCheck: true,
+		})
+
+		return idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+	}
+
+	err = build(true)
+
+	if err == nil {
+		t.Fatalf("Expected failing run to return an error")
+	}
+
+	body, err := os.ReadFile(target)
+
+	if err != nil {
+		t.Fatalf("Failed to read %s, %v", target, err)
+	}
+
+	if string(body) != "previous" {
+		t.Fatalf("Expected %s to be untouched after a failed run", target)
+	}
+
+	err = build(false)
+
+	if err != nil {
+		t.Fatalf("Failed to index and swap database, %v", err)
+	}
+
+	conn, err := sql.Open("sqlite", target)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s, %v", target, err)
+	}
+
+	defer conn.Close()
+
+	var count int
+
+	err = conn.QueryRowContext(f.ctx, "SELECT COUNT(*) FROM example").Scan(&count)
+
+	if err != nil {
+		t.Fatalf("Failed to count rows in %s, %v", target, err)
+	}
+
+	if count == 0 {
+		t.Fatalf("Expected swapped database to contain rows")
+	}
+
+	matches, err := filepath.Glob(filepath.Join(f.tmpdir, ".published.db-*"))
+
+	if err != nil {
+		t.Fatalf("Failed to glob temporary files, %v", err)
+	}
+
+	if len(matches) != 0 {
+		t.Fatalf("Expected temporary files to be removed, found %v", matches)
+	}
+}
@@ -0,0 +1,370 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"sync"
+	"sync/atomic"
+)
+
+// Target defines an additional database, and the tables in it, that records are indexed in during the same run (and
+// from the same loaded records) as the indexer's own database.
+type Target struct {
+	// Name is the unique name of the target, used in errors, log messages and statistics.
+	Name string
+	// DB is the `aaronland/go-sqlite.Database` instance that records will be indexed in. It must be nil if `Sharding` is present.
+	DB sqlite.Database
+	// Sharding is an optional `Sharding` definition used to divide records among multiple database files instead of `DB`.
+	Sharding *Sharding
+	// Tables is the list of `aaronland/go-sqlite.Table` instances that records will be indexed in. Each table is
+	// initialized in `DB`, or in each shard when it is opened, at the start of every run. Tables are prepared, migrated
+	// and finalized in the same way as the indexer's own tables (see `TableModes`, `VersionedTable` and `FinalizableTable`).
+	Tables []sqlite.Table
+	// Predicate is an optional `SQLiteIndexerRoutingFunc` function used to decide whether a record should be indexed
+	// in the target. If nil every record is indexed.
+	Predicate SQLiteIndexerRoutingFunc
+	// LockBatchSize is the optional number of records to queue before writing them to `DB`, in order, while acquiring its
+	// lock once rather than once per record. Records are not written in a single transaction: each table's `IndexRecord`
+	// method is still invoked once for each record. If zero records are written one at a time.
+	LockBatchSize int
+}
+
+// TargetStats is a struct containing the counts of records processed by a `Target` during a run.
+type TargetStats struct {
+	// Indexed is the number of records that were indexed in the target.
+	Indexed int64
+	// Skipped is the number of records that did not match the target's predicate.
+	Skipped int64
+	// Failed is the number of records that could not be indexed in the target.
+	Failed int64
+}
+
+// validate returns an error if 't' is not a valid target.
+func (t *Target) validate() error {
+
+	if t.Name == "" {
+		return fmt.Errorf("Missing name")
+	}
+
+	if t.Sharding != nil {
+
+		if t.DB != nil {
+			return fmt.Errorf("Sharded targets must not define a database")
+		}
+
+		err := t.Sharding.validate()
+
+		if err != nil {
+			return fmt.Errorf("Invalid sharding, %w", err)
+		}
+
+	} else if t.DB == nil {
+		return fmt.Errorf("Missing database")
+	}
+
+	if len(t.Tables) == 0 {
+		return fmt.Errorf("No tables defined")
+	}
+
+	if t.LockBatchSize < 0 {
+		return fmt.Errorf("Lock batch size must not be negative")
+	}
+
+	return nil
+}
+
+// targetState is a struct containing the state for a `Target` scoped to a single run.
+type targetState struct {
+	target *Target
+	// mu guards 'queue'.
+	mu    *sync.Mutex
+	queue []*loadedRecord
+	// write_mu is held from the moment a batch is removed from the queue until it has been written, so that batches
+	// are written in the same order they were queued. It is never acquired while holding the indexer's database lock.
+	write_mu *sync.Mutex
+	counts   *TargetStats
+	// shards is the set of shards opened during the run. It is nil unless the target is sharded.
+	shards *shardSet
+}
+
+// newTargetStates returns a new `targetState` instance for each of the indexer's targets.
+func (idx *SQLiteIndexer) newTargetStates() ([]*targetState, error) {
+
+	states := make([]*targetState, len(idx.targets))
+
+	for i, t := range idx.targets {
+
+		states[i] = &targetState{
+			target:   t,
+			mu:       new(sync.Mutex),
+			queue:    make([]*loadedRecord, 0),
+			write_mu: new(sync.Mutex),
+			counts:   new(TargetStats),
+		}
+
+		if t.Sharding != nil {
+
+			shards, err := newShardSet(t)
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to create shards for '%s' target, %w", t.Name, err)
+			}
+
+			states[i].shards = shards
+		}
+	}
+
+	return states, nil
+}
+
+// initializeTargets initializes each of the tables for each of the indexer's (unsharded) targets in that target's database
+// and then prepares and migrates them in the same way as the indexer's own tables.
+func (idx *SQLiteIndexer) initializeTargets(ctx context.Context, run *indexRun) error {
+
+	for _, t := range idx.targets {
+
+		if t.Sharding != nil {
+			continue
+		}
+
+		for _, tb := range t.Tables {
+
+			err := tb.InitializeTable(ctx, t.DB)
+
+			if err != nil {
+				return fmt.Errorf("Failed to initialize '%s' table for '%s' target, %w", tb.Name(), t.Name, err)
+			}
+		}
+
+		err := idx.prepareTables(ctx, t.DB, t.Tables)
+
+		if err != nil {
+			return fmt.Errorf("Failed to prepare tables for '%s' target, %w", t.Name, err)
+		}
+
+		err = idx.migrateTables(ctx, run, t.DB, t.Tables)
+
+		if err != nil {
+			return fmt.Errorf("Failed to migrate tables for '%s' target, %w", t.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// queueTargets adds 'lr' to the queue of each target in 'run' whose predicate it matches and returns the targets whose
+// queues are now full. Callers should pass them to `writeTargets` (even if an error is returned) once the indexer's
+// database lock has been released. It is expected to be called while holding that lock so that records are queued
+// for every target in the same order they were written to the indexer's database.
+func (idx *SQLiteIndexer) queueTargets(ctx context.Context, run *indexRun, lr *loadedRecord) ([]*targetState, error) {
+
+	full := make([]*targetState, 0)
+
+	for _, state := range run.targets {
+
+		t := state.target
+
+		if t.Predicate != nil {
+
+			var matches bool
+
+			err := idx.safeCall(ctx, run, lr, "", func(ctx context.Context) error {
+				m, err := t.Predicate(ctx, lr.record)
+				matches = m
+				return err
+			})
+
+			if err != nil {
+				return full, fmt.Errorf("Failed to match %s for '%s' target, %w", describeRecord(lr.key, lr.path), t.Name, err)
+			}
+
+			if !matches {
+				atomic.AddInt64(&state.counts.Skipped, 1)
+				continue
+			}
+		}
+
+		if state.add(lr) {
+			full = append(full, state)
+		}
+	}
+
+	return full, nil
+}
+
+// add appends 'lr' to the queue and returns a boolean value indicating whether the queue is now full.
+func (state *targetState) add(lr *loadedRecord) bool {
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.queue = append(state.queue, lr)
+	return len(state.queue) >= state.target.LockBatchSize
+}
+
+// take removes and returns the records in the queue. Callers must hold 'write_mu' until the records have been written.
+func (state *targetState) take() []*loadedRecord {
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	records := state.queue
+	state.queue = make([]*loadedRecord, 0)
+
+	return records
+}
+
+// flushTargets writes any records remaining in the queues of each of the targets in 'run'.
+func (idx *SQLiteIndexer) flushTargets(ctx context.Context, run *indexRun) error {
+	return idx.writeTargets(ctx, run, run.targets)
+}
+
+// writeTargets writes the records in the queue of each of 'states' to its target and returns the first error encountered.
+// The queue may be empty if the records were already written by another call. It must not be called while holding the
+// indexer's database lock.
+func (idx *SQLiteIndexer) writeTargets(ctx context.Context, run *indexRun, states []*targetState) error {
+
+	var first_err error
+
+	for _, state := range states {
+
+		state.write_mu.Lock()
+
+		records := state.take()
+
+		var err error
+
+		if len(records) > 0 {
+			err = idx.writeTargetRecords(ctx, run, state, records)
+		}
+
+		state.write_mu.Unlock()
+
+		if err != nil && first_err == nil {
+			first_err = err
+		}
+	}
+
+	return first_err
+}
+
+// writeTargetRecords indexes each of 'records' in each of the tables of the target for 'state' while holding the target's
+// database lock. If the target is sharded each record is written to its shard and the lock for each shard is held
+// until a record for a different shard is encountered. Records that can not be indexed are counted as failures and
+// the remaining records are still written; the error for the first of them is returned once every record has been
+// written. Record keys are expected to have been derived before the records were queued.
+func (idx *SQLiteIndexer) writeTargetRecords(ctx context.Context, run *indexRun, state *targetState, records []*loadedRecord) error {
+
+	t := state.target
+
+	var locked sqlite.Database
+
+	defer func() {
+
+		if locked != nil {
+			locked.Unlock(ctx)
+		}
+	}()
+
+	var first_err error
+
+	for _, lr := range records {
+
+		fail := func(table string, err error) {
+
+			atomic.AddInt64(&state.counts.Failed, 1)
+
+			run.logger.Error("Failed to index record", "path", lr.path, "key", lr.key, "target", t.Name, "table", table, "error", err)
+
+			if first_err == nil {
+				first_err = &TargetError{Target: t.Name, Err: &TableIndexError{Path: lr.path, Key: lr.key, Table: table, Err: err}}
+			}
+		}
+
+		db := t.DB
+
+		var s *shard
+
+		if state.shards != nil {
+
+			sh, err := idx.shardRecord(ctx, run, state.shards, lr)
+
+			if err != nil {
+				fail("", err)
+				continue
+			}
+
+			s = sh
+			db = s.db
+		}
+
+		if db != locked {
+
+			if locked != nil {
+				locked.Unlock(ctx)
+			}
+
+			db.Lock(ctx)
+			locked = db
+		}
+
+		var table_err error
+
+		for _, tb := range t.Tables {
+
+			label := func() string {
+				return fmt.Sprintf("%s in '%s' table for '%s' target", describeRecord(lr.key, lr.path), tb.Name(), t.Name)
+			}
+
+			err := idx.withRetries(ctx, run, label, func() error {
+
+				return idx.callWithTimeout(ctx, idx.tableTimeout(tb.Name()), run, lr, tb.Name(), func(ctx context.Context) error {
+
+					return withGuardedDatabase(ctx, db, func(ctx context.Context) error {
+						return tb.IndexRecord(ctx, db, lr.record)
+					})
+				})
+			})
+
+			if err != nil {
+				fail(tb.Name(), err)
+				table_err = err
+				break
+			}
+		}
+
+		if table_err != nil {
+			continue
+		}
+
+		if s != nil {
+			s.add(lr.key)
+		}
+
+		atomic.AddInt64(&state.counts.Indexed, 1)
+	}
+
+	run.logger.Debug("Indexed records in target", "target", t.Name, "count", len(records))
+	return first_err
+}
+
+// reportTargetStats stores the counts of records processed by each of the targets in 'run' so they can be retrieved
+// by the `TargetStats` method.
+func (idx *SQLiteIndexer) reportTargetStats(run *indexRun) {
+
+	stats := make(map[string]*TargetStats)
+
+	for _, state := range run.targets {
+
+		stats[state.target.Name] = &TargetStats{
+			Indexed: atomic.LoadInt64(&state.counts.Indexed),
+			Skipped: atomic.LoadInt64(&state.counts.Skipped),
+			Failed:  atomic.LoadInt64(&state.counts.Failed),
+		}
+	}
+
+	idx.mu.Lock()
+	idx.target_stats = stats
+	idx.mu.Unlock()
+}
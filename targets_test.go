@@ -0,0 +1,275 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/aaronland/go-sqlite/v2/tables"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTargets(t *testing.T) {
+
+	f := newTestFixture(t, "targets.db")
+
+	all_db := f.openDatabase(t, "all.db")
+	tests_db := f.openDatabase(t, "tests.db")
+
+	countRows := func(db sqlite.Database) int {
+		return f.count(t, db, "SELECT COUNT(*) FROM example")
+	}
+
+	// Target tables are initialized by the indexer
+
+	all_t, err := tables.NewExampleTable(f.ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to create example table, %v", err)
+	}
+
+	tests_t, err := tables.NewExampleTable(f.ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to create example table, %v", err)
+	}
+
+	predicate, err := NewQueryRoutingFunc([]string{`path=_test\.go$`}, "")
+
+	if err != nil {
+		t.Fatalf("Failed to create query routing function, %v", err)
+	}
+
+	loads := int64(0)
+
+	record_func := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+		atomic.AddInt64(&loads, 1)
+		return pathRecord(ctx, path, r, args...)
+	}
+
+	idx_opts := &SQLiteIndexerOptions{
+		LoadRecordFunc: record_func,
+		Targets: []*Target{
+			&Target{Name: "all", DB: all_db, Tables: []sqlite.Table{all_t}, LockBatchSize: 2},
+			&Target{Name: "tests", DB: tests_db, Tables: []sqlite.Table{tests_t}, Predicate: predicate},
+		},
+	}
+
+	idx := f.indexer(t, idx_opts)
+
+	err = idx.IndexURIs(f.ctx, "directory://", f.path("config"), f.path("cmd"))
+
+	if err != nil {
+		t.Fatalf("Failed to index URIs, %v", err)
+	}
+
+	if loads != 3 {
+		t.Fatalf("Expected each record to be loaded once, got %d loads", loads)
+	}
+
+	if countRows(f.db) != 3 || countRows(all_db) != 3 {
+		t.Fatalf("Expected every record to be indexed in the database and the 'all' target")
+	}
+
+	if countRows(tests_db) != 1 {
+		t.Fatalf("Expected only config_test.go to be indexed in the 'tests' target")
+	}
+
+	stats := idx.TargetStats()
+
+	if stats["all"].Indexed != 3 || stats["tests"].Indexed != 1 || stats["tests"].Skipped != 2 {
+		t.Fatalf("Unexpected target stats, %v %v", stats["all"], stats["tests"])
+	}
+
+	idx_opts.Targets = append(idx_opts.Targets, &Target{Name: "all", DB: all_db, Tables: []sqlite.Table{all_t}})
+
+	_, err = NewSQLiteIndexer(idx_opts)
+
+	if err == nil {
+		t.Fatalf("Expected duplicate target to fail")
+	}
+}
+
+// FailingTestsTable is an example table that fails to index records produced by `pathRecord` for test files.
+type FailingTestsTable struct {
+	sqlite.Table
+}
+
+func (t *FailingTestsTable) IndexRecord(ctx context.Context, db sqlite.Database, record interface{}) error {
+
+	path, err := pathKey(record)
+
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(path, "_test.go") {
+		return fmt.Errorf("Invalid record")
+	}
+
+	return t.Table.IndexRecord(ctx, db, record)
+}
+
+func TestTargetFailure(t *testing.T) {
+
+	f := newTestFixture(t, "targets.db")
+
+	failing_db := f.openDatabase(t, "failing.db")
+
+	idx := f.indexer(t, &SQLiteIndexerOptions{
+		Targets: []*Target{
+			&Target{Name: "failing", DB: failing_db, Tables: []sqlite.Table{&FailingTable{}}},
+		},
+	})
+
+	err := idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+	var target_err *TargetError
+
+	if !errors.As(err, &target_err) || target_err.Target != "failing" {
+		t.Fatalf("Expected target error, got %v", err)
+	}
+
+	// The record was indexed in the database so it is only counted as a failure for the target
+
+	stats := idx.Stats()
+
+	if stats.Indexed != 1 || stats.Failed != 0 {
+		t.Fatalf("Expected record to be counted once, got %v", stats)
+	}
+
+	if idx.TargetStats()["failing"].Failed != 1 {
+		t.Fatalf("Expected record to be counted as a failure for the target, got %v", idx.TargetStats()["failing"])
+	}
+}
+
+func TestTargetBatchFailure(t *testing.T) {
+
+	f := newTestFixture(t, "targets.db")
+
+	target_db := f.openDatabase(t, "batch.db")
+
+	example_t, err := tables.NewExampleTable(f.ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to create example table, %v", err)
+	}
+
+	idx_opts := &SQLiteIndexerOptions{
+		LoadRecordFunc: pathRecord,
+		Targets: []*Target{
+			&Target{Name: "batch", DB: target_db, Tables: []sqlite.Table{&FailingTestsTable{example_t}}, LockBatchSize: 10},
+		},
+	}
+
+	idx := f.indexer(t, idx_opts)
+
+	err = idx.IndexURIs(f.ctx, "directory://", f.path("config"), f.path("cmd"))
+
+	var target_err *TargetError
+
+	if !errors.As(err, &target_err) {
+		t.Fatalf("Expected target error, got %v", err)
+	}
+
+	// Only config_test.go fails, the other records in the same batch are still written
+
+	stats := idx.TargetStats()["batch"]
+
+	if stats.Indexed != 2 || stats.Failed != 1 {
+		t.Fatalf("Expected only the failing record to be counted as a failure, got %v", stats)
+	}
+
+	if f.count(t, target_db, "SELECT COUNT(*) FROM example") != 2 {
+		t.Fatalf("Expected the records that did not fail to be indexed in the target")
+	}
+
+	idx_opts.Targets = []*Target{nil}
+
+	_, err = NewSQLiteIndexer(idx_opts)
+
+	if err == nil {
+		t.Fatalf("Expected empty target to fail")
+	}
+}
+
+func TestTargetTableLifecycle(t *testing.T) {
+
+	f := newTestFixture(t, "targets.db")
+
+	target_db := f.openDatabase(t, "lifecycle.db")
+
+	example_t, err := tables.NewExampleTable(f.ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to create example table, %v", err)
+	}
+
+	build := func(tb sqlite.Table) *SQLiteIndexer {
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			TableModes: map[string]string{
+				"example": TABLE_MODE_TRUNCATE,
+			},
+			Targets: []*Target{
+				&Target{Name: "lifecycle", DB: target_db, Tables: []sqlite.Table{tb}},
+				&Target{Name: "shards", Sharding: &Sharding{Path: filepath.Join(f.tmpdir, "lifecycle-shard.db"), MaxSize: 1 << 30}, Tables: []sqlite.Table{tb}},
+			},
+		})
+
+		err := idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+
+		if err != nil {
+			t.Fatalf("Failed to index URIs, %v", err)
+		}
+
+		return idx
+	}
+
+	// Target tables are prepared according to the indexer's table modes
+
+	build(example_t)
+	count := f.count(t, target_db, "SELECT COUNT(*) FROM example")
+
+	idx := build(&FinalizableExampleTable{example_t})
+
+	if f.count(t, target_db, "SELECT COUNT(*) FROM example") != count {
+		t.Fatalf("Expected target table to be truncated")
+	}
+
+	// Target tables are finalized in the target's database and in each shard
+
+	steps := make(map[string]int)
+
+	for _, timing := range idx.FinalizeTimings() {
+		steps[timing.Step] += 1
+	}
+
+	if steps["target:lifecycle:table:example"] != 1 || steps["target:shards:table:example"] != 1 {
+		t.Fatalf("Expected target tables to be finalized, got %v", steps)
+	}
+
+	shard_db := f.openDatabase(t, "lifecycle-shard-0001.db")
+
+	q := "SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND name='example_by_id'"
+
+	if f.count(t, target_db, q) != 1 || f.count(t, shard_db, q) != 1 {
+		t.Fatalf("Expected target tables to be finalized")
+	}
+
+	// Shards are removed at the start of each run so close the shard before it is recreated
+
+	shard_db.Close(f.ctx)
+
+	// Target tables are migrated in the same way as the indexer's tables
+
+	build(&VersionedExampleTable{example_t, 1})
+
+	if f.count(t, target_db, "SELECT version FROM _schema_versions WHERE name = 'example'") != 1 {
+		t.Fatalf("Expected schema version to be recorded in the target's database")
+	}
+}
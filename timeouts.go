@@ -0,0 +1,195 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SlowRecord is a struct describing a record whose load time, or time to index in one or more tables, exceeded
+// the indexer's slow record threshold.
+type SlowRecord struct {
+	// Key is the key of the record. It may be empty if no key could be derived.
+	Key string
+	// Path is the path of the record, as reported by its source.
+	Path string
+	// Load is the time it took to load the record.
+	Load time.Duration
+	// Tables is a map of table names and the time it took to index the record in that table (whether or not it succeeded).
+	Tables map[string]time.Duration
+}
+
+// String returns a human-readable description of the slow record and its per-table timings.
+func (s *SlowRecord) String() string {
+
+	names := make([]string, 0, len(s.Tables))
+
+	for name, _ := range s.Tables {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	timings := make([]string, len(names))
+
+	for i, name := range names {
+		timings[i] = fmt.Sprintf("%s=%v", name, s.Tables[name])
+	}
+
+	label := s.Path
+
+	if s.Key != "" {
+		label = fmt.Sprintf("%s (%s)", s.Key, s.Path)
+	}
+
+	return fmt.Sprintf("%s load=%v %s", label, s.Load, strings.Join(timings, " "))
+}
+
+// slowRecords is a struct for collecting the slow records encountered during a run.
+type slowRecords struct {
+	mu      *sync.Mutex
+	records []*SlowRecord
+}
+
+// newSlowRecords returns a new `slowRecords` instance.
+func newSlowRecords() *slowRecords {
+
+	s := &slowRecords{
+		mu:      new(sync.Mutex),
+		records: make([]*SlowRecord, 0),
+	}
+
+	return s
+}
+
+// Add appends 'r' to the list of slow records.
+func (s *slowRecords) Add(r *SlowRecord) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, r)
+}
+
+// Records returns the list of slow records, sorted by the longest of their load and per-table times in descending order.
+func (s *slowRecords) Records() []*SlowRecord {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]*SlowRecord, len(s.records))
+	copy(records, s.records)
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return slowest(records[i]) > slowest(records[j])
+	})
+
+	return records
+}
+
+// slowest returns the longest of the load and per-table times for 'r'.
+func slowest(r *SlowRecord) time.Duration {
+
+	d := r.Load
+
+	for _, t := range r.Tables {
+
+		if t > d {
+			d = t
+		}
+	}
+
+	return d
+}
+
+// callWithTimeout invokes 'fn', using the `safeCall` method, with a context derived from 'ctx' that expires after 'timeout'.
+// If the deadline has passed by the time 'fn' returns an error wrapping `context.DeadlineExceeded` is returned, even if 'fn'
+// ignored its context and did not return an error. 'fn' is expected to return as soon as possible once its context expires
+// (any transactions it started with that context will be rolled back) but it is never abandoned: 'fn' may still be using the
+// database, or the record's reader, so the caller (and any locks it holds) waits for it to return. If 'timeout' is zero 'fn'
+// is invoked without a deadline.
+func (idx *SQLiteIndexer) callWithTimeout(ctx context.Context, timeout time.Duration, run *indexRun, lr *loadedRecord, table string, fn func(context.Context) error) error {
+
+	if timeout <= 0 {
+		return idx.safeCall(ctx, run, lr, table, fn)
+	}
+
+	// The deadline is checked explicitly, as well as the context's error, since the context may not have
+	// been marked as expired yet when 'fn' returns
+
+	deadline := time.Now().Add(timeout)
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	err := idx.safeCall(ctx, run, lr, table, fn)
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || !time.Now().Before(deadline) {
+		return fmt.Errorf("Timed out after %v, %w", timeout, context.DeadlineExceeded)
+	}
+
+	return err
+}
+
+// tableTimeout returns the timeout for indexing an individual record in the table named 'name'.
+func (idx *SQLiteIndexer) tableTimeout(name string) time.Duration {
+
+	timeout, ok := idx.table_timeouts[name]
+
+	if ok {
+		return timeout
+	}
+
+	return idx.table_timeout
+}
+
+// checkSlowRecord adds 'lr' to the list of slow records for 'run', and logs it, if its load time or any of the times
+// in 'timings' exceed the indexer's slow record threshold. 'timings' is nil for records that were not written.
+func (idx *SQLiteIndexer) checkSlowRecord(run *indexRun, lr *loadedRecord, timings map[string]time.Duration) {
+
+	if idx.slow_record_threshold <= 0 {
+		return
+	}
+
+	r := &SlowRecord{
+		Key:    lr.key,
+		Path:   lr.path,
+		Load:   lr.load,
+		Tables: timings,
+	}
+
+	if slowest(r) < idx.slow_record_threshold {
+		return
+	}
+
+	if r.Key == "" && lr.record != nil {
+
+		key, err := idx.deriveKey(context.Background(), lr)
+
+		if err == nil {
+			r.Key = key
+		}
+	}
+
+	run.slow_records.Add(r)
+	run.logger.Warn("Slow record", "path", r.Path, "key", r.Key, "load", r.Load, "tables", r.Tables)
+}
+
+// reportSlowRecords stores the slow records encountered during 'run' so they can be retrieved by the `SlowRecords`
+// method and logs how many there were.
+func (idx *SQLiteIndexer) reportSlowRecords(run *indexRun) {
+
+	records := run.slow_records.Records()
+
+	idx.mu.Lock()
+	idx.slow_records = records
+	idx.mu.Unlock()
+
+	if len(records) > 0 {
+		run.logger.Info("Records exceeded the slow record threshold", "count", len(records), "threshold", idx.slow_record_threshold)
+	}
+}
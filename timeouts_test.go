@@ -0,0 +1,168 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aaronland/go-sqlite/v2"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type SlowTable struct {
+	FailingTable
+	Delay time.Duration
+}
+
+func (t *SlowTable) IndexRecord(ctx context.Context, db sqlite.Database, record interface{}) error {
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(t.Delay):
+		return nil
+	}
+}
+
+type StubbornTable struct {
+	FailingTable
+	Returned int32
+	// Succeed signals that the table should return nil, rather than an error, once it has finished sleeping.
+	Succeed bool
+}
+
+func (t *StubbornTable) IndexRecord(ctx context.Context, db sqlite.Database, record interface{}) error {
+
+	time.Sleep(20 * time.Millisecond)
+	atomic.StoreInt32(&t.Returned, 1)
+
+	if t.Succeed {
+		return nil
+	}
+
+	return fmt.Errorf("Failed to index record")
+}
+
+func TestTimeouts(t *testing.T) {
+
+	f := newTestFixture(t, "timeouts.db")
+
+	build := func(opts *SQLiteIndexerOptions, delay time.Duration) (*SQLiteIndexer, error) {
+
+		opts.Tables = []sqlite.Table{f.example, &SlowTable{Delay: delay}}
+
+		idx := f.indexer(t, opts)
+		return idx, idx.IndexURIs(f.ctx, "directory://", f.path("cmd"))
+	}
+
+	_, err := build(&SQLiteIndexerOptions{
+		TableTimeouts: map[string]time.Duration{"names": time.Millisecond},
+	}, 2*time.Second)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected required table to time out, got %v", err)
+	}
+
+	// The timeout applies to the example table too so it must allow it to finish writing
+
+	idx, err := build(&SQLiteIndexerOptions{
+		TableTimeout:  200 * time.Millisecond,
+		TablePolicies: map[string]*TablePolicy{"names": &TablePolicy{Policy: TABLE_POLICY_BEST_EFFORT}},
+	}, 2*time.Second)
+
+	if err != nil {
+		t.Fatalf("Expected best-effort table not to fail, %v", err)
+	}
+
+	if idx.TableFailures()["names"] == 0 {
+		t.Fatalf("Expected timeouts to be counted as table failures")
+	}
+
+	slow_func := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	_, err = build(&SQLiteIndexerOptions{
+		LoadRecordFunc: slow_func,
+		LoadTimeout:    time.Millisecond,
+	}, 0)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected loader to time out, got %v", err)
+	}
+
+	idx, err = build(&SQLiteIndexerOptions{
+		SlowRecordThreshold: 10 * time.Millisecond,
+	}, 20*time.Millisecond)
+
+	if err != nil {
+		t.Fatalf("Failed to index records, %v", err)
+	}
+
+	slow := idx.SlowRecords()
+
+	if len(slow) == 0 {
+		t.Fatalf("Expected slow records")
+	}
+
+	if slow[0].Path == "" || slow[0].Tables["names"] < 20*time.Millisecond {
+		t.Fatalf("Unexpected slow record %s", slow[0])
+	}
+
+	// Tables that ignore their context are waited for rather than abandoned
+
+	stubborn_t := &StubbornTable{}
+
+	idx = f.indexer(t, &SQLiteIndexerOptions{
+		Tables:       []sqlite.Table{stubborn_t},
+		TableTimeout: time.Millisecond,
+	})
+
+	err = idx.IndexURIs(f.ctx, "directory://", f.path("cmd"))
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected stubborn table to time out, got %v", err)
+	}
+
+	if atomic.LoadInt32(&stubborn_t.Returned) != 1 {
+		t.Fatalf("Expected indexer to wait for stubborn table to return")
+	}
+
+	// Tables that ignore their context time out even if they do not return an error
+
+	idx = f.indexer(t, &SQLiteIndexerOptions{
+		Tables:       []sqlite.Table{&StubbornTable{Succeed: true}},
+		TableTimeout: time.Millisecond,
+	})
+
+	err = idx.IndexURIs(f.ctx, "directory://", f.path("cmd"))
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected stubborn table that does not return an error to time out, got %v", err)
+	}
+
+	// Slow loads are reported even if the record is not written
+
+	empty_func := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+		time.Sleep(20 * time.Millisecond)
+		return nil, nil
+	}
+
+	idx, err = build(&SQLiteIndexerOptions{
+		LoadRecordFunc:      empty_func,
+		SlowRecordThreshold: 10 * time.Millisecond,
+	}, 0)
+
+	if err != nil {
+		t.Fatalf("Failed to index records, %v", err)
+	}
+
+	slow = idx.SlowRecords()
+
+	if len(slow) == 0 || slow[0].Load < 20*time.Millisecond || len(slow[0].Tables) != 0 {
+		t.Fatalf("Expected slow loads of skipped records to be reported, got %v", slow)
+	}
+}
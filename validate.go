@@ -0,0 +1,413 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"math"
+	"strings"
+	"time"
+)
+
+// Validator is an interface for checking that a record returned by a `SQLiteIndexerLoadRecordFunc` function is valid
+// before it is indexed.
+type Validator interface {
+	// Name returns the name of the rule the validator enforces.
+	Name() string
+	// Validate returns an error if the record, or its JSON encoding, fails the validator's rule. The record is encoded
+	// once and the same encoding is passed to every validator.
+	Validate(context.Context, interface{}, []byte) error
+}
+
+// ValidationFailure is a struct describing a validator rule that a record failed.
+type ValidationFailure struct {
+	// Rule is the name of the validator that failed.
+	Rule string
+	// Err is the error returned by the validator.
+	Err error
+}
+
+// ValidationError is an error describing a record that failed one or more validators.
+type ValidationError struct {
+	// Path is the path of the record, as reported by its source.
+	Path string
+	// Key is the key of the record. It may be empty if no key could be derived.
+	Key string
+	// Failures is the list of every validator rule the record failed.
+	Failures []*ValidationFailure
+}
+
+// Error returns a description of the error, including every failed rule.
+func (e *ValidationError) Error() string {
+
+	failures := make([]string, len(e.Failures))
+
+	for i, f := range e.Failures {
+		failures[i] = fmt.Sprintf("%s: %v", f.Rule, f.Err)
+	}
+
+	return fmt.Sprintf("Failed to validate %s, %s", describeRecord(e.Key, e.Path), strings.Join(failures, "; "))
+}
+
+// Unwrap returns the errors returned by each of the failed validators.
+func (e *ValidationError) Unwrap() []error {
+
+	errors := make([]error, len(e.Failures))
+
+	for i, f := range e.Failures {
+		errors[i] = f.Err
+	}
+
+	return errors
+}
+
+// isValidValidationPolicy returns a boolean value indicating whether 'policy' is a valid validation policy.
+func isValidValidationPolicy(policy string) bool {
+
+	switch policy {
+	case TABLE_POLICY_REQUIRED, TABLE_POLICY_BEST_EFFORT:
+		return true
+	default:
+		return false
+	}
+}
+
+// validateRecord runs each of the indexer's validators against 'lr', and its JSON encoding, returning a `ValidationError` listing
+// every rule it failed, if any. Records that can not be encoded fail an "encoding" rule without running any validators.
+func (idx *SQLiteIndexer) validateRecord(ctx context.Context, run *indexRun, lr *loadedRecord) error {
+
+	var body []byte
+
+	err := idx.safeCall(ctx, run, lr, "", func(ctx context.Context) error {
+		b, err := recordBody(lr.record)
+		body = b
+		return err
+	})
+
+	if err != nil {
+
+		return &ValidationError{
+			Path:     lr.path,
+			Key:      idx.recordKey(lr),
+			Failures: []*ValidationFailure{&ValidationFailure{Rule: "encoding", Err: err}},
+		}
+	}
+
+	failures := make([]*ValidationFailure, 0)
+
+	for _, v := range idx.validators {
+
+		err := idx.safeCall(ctx, run, lr, "", func(ctx context.Context) error {
+			return v.Validate(ctx, lr.record, body)
+		})
+
+		if err != nil {
+			failures = append(failures, &ValidationFailure{Rule: v.Name(), Err: err})
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	return &ValidationError{
+		Path:     lr.path,
+		Key:      idx.recordKey(lr),
+		Failures: failures,
+	}
+}
+
+// wof_placetypes is the list of known Who's On First placetypes.
+var wof_placetypes = map[string]bool{
+	"address":       true,
+	"arcade":        true,
+	"borough":       true,
+	"building":      true,
+	"campus":        true,
+	"concourse":     true,
+	"constituency":  true,
+	"continent":     true,
+	"country":       true,
+	"county":        true,
+	"custom":        true,
+	"dependency":    true,
+	"disputed":      true,
+	"empire":        true,
+	"enclosure":     true,
+	"installation":  true,
+	"intersection":  true,
+	"localadmin":    true,
+	"locality":      true,
+	"macrocounty":   true,
+	"macrohood":     true,
+	"macroregion":   true,
+	"marinearea":    true,
+	"marketarea":    true,
+	"metroarea":     true,
+	"microhood":     true,
+	"neighbourhood": true,
+	"ocean":         true,
+	"planet":        true,
+	"postalcode":    true,
+	"postalregion":  true,
+	"region":        true,
+	"timezone":      true,
+	"venue":         true,
+	"wing":          true,
+}
+
+// geojson_geometry_types is the list of valid GeoJSON geometry types.
+var geojson_geometry_types = map[string]bool{
+	"Point":              true,
+	"MultiPoint":         true,
+	"LineString":         true,
+	"MultiLineString":    true,
+	"Polygon":            true,
+	"MultiPolygon":       true,
+	"GeometryCollection": true,
+}
+
+// wof_earliest_lastmodified is the earliest plausible value for a Who's On First last modified time (2015-01-01).
+const wof_earliest_lastmodified int64 = 1420070400
+
+// wof_bbox_tolerance is the maximum difference, in degrees, allowed between a bounding box and the extent of its geometry.
+const wof_bbox_tolerance float64 = 0.000001
+
+// wofValidator is a `Validator` that applies a rule to the JSON encoding of a Who's On First record.
+type wofValidator struct {
+	name     string
+	validate func([]byte) error
+}
+
+// Name returns the name of the validator's rule.
+func (v *wofValidator) Name() string {
+	return v.name
+}
+
+// Validate returns an error if 'body', the JSON encoding of 'record', fails the validator's rule.
+func (v *wofValidator) Validate(ctx context.Context, record interface{}, body []byte) error {
+	return v.validate(body)
+}
+
+// NewWOFIDValidator returns a `Validator` that ensures records have a positive `wof:id` property.
+func NewWOFIDValidator() Validator {
+
+	fn := func(body []byte) error {
+
+		rsp, err := wofProperty(body, wof_id_paths)
+
+		if err != nil {
+			return err
+		}
+
+		if rsp.Type != gjson.Number || rsp.Int() <= 0 {
+			return fmt.Errorf("Invalid ID '%s'", rsp.Raw)
+		}
+
+		return nil
+	}
+
+	return &wofValidator{name: "wof:id", validate: fn}
+}
+
+// NewWOFPlacetypeValidator returns a `Validator` that ensures records have a known `wof:placetype` property.
+func NewWOFPlacetypeValidator() Validator {
+
+	fn := func(body []byte) error {
+
+		rsp, err := wofProperty(body, []string{"properties.wof:placetype", "wof:placetype"})
+
+		if err != nil {
+			return err
+		}
+
+		if !wof_placetypes[rsp.String()] {
+			return fmt.Errorf("Unknown placetype '%s'", rsp.String())
+		}
+
+		return nil
+	}
+
+	return &wofValidator{name: "wof:placetype", validate: fn}
+}
+
+// NewWOFGeometryTypeValidator returns a `Validator` that ensures records have a geometry with a valid GeoJSON type.
+func NewWOFGeometryTypeValidator() Validator {
+
+	fn := func(body []byte) error {
+
+		rsp := gjson.GetBytes(body, "geometry.type")
+
+		if !rsp.Exists() {
+			return fmt.Errorf("Record is missing geometry.type property")
+		}
+
+		if !geojson_geometry_types[rsp.String()] {
+			return fmt.Errorf("Invalid geometry type '%s'", rsp.String())
+		}
+
+		return nil
+	}
+
+	return &wofValidator{name: "geometry:type", validate: fn}
+}
+
+// NewWOFCoordinatesValidator returns a `Validator` that ensures every coordinate in a record's geometry is a valid
+// longitude and latitude.
+func NewWOFCoordinatesValidator() Validator {
+
+	fn := func(body []byte) error {
+
+		var invalid error
+
+		walkCoordinates(gjson.GetBytes(body, "geometry"), func(lon float64, lat float64) bool {
+
+			if lon < -180.0 || lon > 180.0 || lat < -90.0 || lat > 90.0 {
+				invalid = fmt.Errorf("Coordinate (%f, %f) is out of range", lon, lat)
+				return false
+			}
+
+			return true
+		})
+
+		return invalid
+	}
+
+	return &wofValidator{name: "geometry:coordinates", validate: fn}
+}
+
+// NewWOFBoundingBoxValidator returns a `Validator` that ensures a record's bounding box, if present, matches the extent
+// of its geometry.
+func NewWOFBoundingBoxValidator() Validator {
+
+	fn := func(body []byte) error {
+
+		bbox := gjson.GetBytes(body, "bbox")
+
+		if !bbox.Exists() {
+			return nil
+		}
+
+		values := bbox.Array()
+
+		if len(values) != 4 {
+			return fmt.Errorf("Bounding box must have 4 values, not %d", len(values))
+		}
+
+		min_x := math.Inf(1)
+		min_y := math.Inf(1)
+		max_x := math.Inf(-1)
+		max_y := math.Inf(-1)
+
+		walkCoordinates(gjson.GetBytes(body, "geometry"), func(lon float64, lat float64) bool {
+			min_x = math.Min(min_x, lon)
+			min_y = math.Min(min_y, lat)
+			max_x = math.Max(max_x, lon)
+			max_y = math.Max(max_y, lat)
+			return true
+		})
+
+		if math.IsInf(min_x, 1) {
+			return fmt.Errorf("Bounding box defined for record without coordinates")
+		}
+
+		extent := []float64{min_x, min_y, max_x, max_y}
+
+		for i, v := range values {
+
+			if math.Abs(v.Float()-extent[i]) > wof_bbox_tolerance {
+				return fmt.Errorf("Bounding box %s does not match geometry extent [%f,%f,%f,%f]", bbox.Raw, min_x, min_y, max_x, max_y)
+			}
+		}
+
+		return nil
+	}
+
+	return &wofValidator{name: "bbox", validate: fn}
+}
+
+// NewWOFLastModifiedValidator returns a `Validator` that ensures records have a `wof:lastmodified` property that
+// is neither earlier than 2015-01-01 nor more than a day in the future.
+func NewWOFLastModifiedValidator() Validator {
+
+	fn := func(body []byte) error {
+
+		rsp, err := wofProperty(body, wof_lastmodified_paths)
+
+		if err != nil {
+			return err
+		}
+
+		lastmod := rsp.Int()
+		latest := time.Now().Add(24 * time.Hour).Unix()
+
+		if rsp.Type != gjson.Number || lastmod < wof_earliest_lastmodified || lastmod > latest {
+			return fmt.Errorf("Implausible last modified time '%s'", rsp.Raw)
+		}
+
+		return nil
+	}
+
+	return &wofValidator{name: "wof:lastmodified", validate: fn}
+}
+
+// WOFValidators returns the list of built-in Who's On First validators.
+func WOFValidators() []Validator {
+
+	validators := []Validator{
+		NewWOFIDValidator(),
+		NewWOFPlacetypeValidator(),
+		NewWOFGeometryTypeValidator(),
+		NewWOFCoordinatesValidator(),
+		NewWOFBoundingBoxValidator(),
+		NewWOFLastModifiedValidator(),
+	}
+
+	return validators
+}
+
+// walkCoordinates invokes 'cb' for each (longitude, latitude) pair in the GeoJSON geometry 'geom' until 'cb' returns false.
+func walkCoordinates(geom gjson.Result, cb func(float64, float64) bool) bool {
+
+	if geom.Get("type").String() == "GeometryCollection" {
+
+		for _, g := range geom.Get("geometries").Array() {
+
+			if !walkCoordinates(g, cb) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return walkPositions(geom.Get("coordinates"), cb)
+}
+
+// walkPositions invokes 'cb' for each position in the (nested) GeoJSON coordinates 'coords' until 'cb' returns false.
+func walkPositions(coords gjson.Result, cb func(float64, float64) bool) bool {
+
+	values := coords.Array()
+
+	if len(values) == 0 {
+		return true
+	}
+
+	if values[0].Type == gjson.Number {
+
+		if len(values) < 2 {
+			return true
+		}
+
+		return cb(values[0].Float(), values[1].Float())
+	}
+
+	for _, v := range values {
+
+		if !walkPositions(v, cb) {
+			return false
+		}
+	}
+
+	return true
+}
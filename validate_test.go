@@ -0,0 +1,153 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+const valid_feature string = `{
+  "type": "Feature",
+  "properties": {"wof:id": 85922583, "wof:placetype": "locality", "wof:lastmodified": 1700000000},
+  "bbox": [-122.5, 37.7, -122.3, 37.8],
+  "geometry": {"type": "Polygon", "coordinates": [[[-122.5, 37.7], [-122.3, 37.7], [-122.3, 37.8], [-122.5, 37.8], [-122.5, 37.7]]]}
+}`
+
+const invalid_feature string = `{
+  "type": "Feature",
+  "properties": {"wof:id": -1, "wof:placetype": "village", "wof:lastmodified": 1700000000},
+  "bbox": [-122.5, 37.7, -122.3, 37.8],
+  "geometry": {"type": "Point", "coordinates": [-222.4, 37.75]}
+}`
+
+type CountingExample struct {
+	Body    string
+	Encoded int
+}
+
+func (e *CountingExample) MarshalJSON() ([]byte, error) {
+	e.Encoded += 1
+	return []byte(e.Body), nil
+}
+
+func TestWOFValidators(t *testing.T) {
+
+	ctx := context.Background()
+
+	for _, v := range WOFValidators() {
+
+		err := v.Validate(ctx, nil, []byte(valid_feature))
+
+		if err != nil {
+			t.Fatalf("Expected valid feature to pass '%s' validator, %v", v.Name(), err)
+		}
+	}
+
+	metroarea_feature := strings.Replace(valid_feature, `"locality"`, `"metroarea"`, 1)
+
+	for _, v := range WOFValidators() {
+
+		err := v.Validate(ctx, nil, []byte(metroarea_feature))
+
+		if err != nil {
+			t.Fatalf("Expected metroarea feature to pass '%s' validator, %v", v.Name(), err)
+		}
+	}
+
+	idx, err := NewSQLiteIndexer(&SQLiteIndexerOptions{
+		Validators: WOFValidators(),
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to create sqlite indexer because %v", err)
+	}
+
+	err = idx.validateRecord(ctx, nil, &loadedRecord{path: "invalid.geojson", record: []byte(invalid_feature)})
+
+	var v_err *ValidationError
+
+	if !errors.As(err, &v_err) {
+		t.Fatalf("Expected ValidationError, got %v", err)
+	}
+
+	failed := make([]string, len(v_err.Failures))
+
+	for i, f := range v_err.Failures {
+		failed[i] = f.Rule
+	}
+
+	expected := "wof:id,wof:placetype,geometry:coordinates,bbox"
+
+	if strings.Join(failed, ",") != expected {
+		t.Fatalf("Expected %s rules to fail, got %s", expected, strings.Join(failed, ","))
+	}
+
+	// Records are encoded once no matter how many validators there are
+
+	record := &CountingExample{Body: valid_feature}
+
+	err = idx.validateRecord(ctx, nil, &loadedRecord{path: "valid.geojson", record: record})
+
+	if err != nil {
+		t.Fatalf("Expected valid feature to pass validation, %v", err)
+	}
+
+	if record.Encoded != 1 {
+		t.Fatalf("Expected record to be encoded once, got %d", record.Encoded)
+	}
+}
+
+func TestValidationPolicy(t *testing.T) {
+
+	f := newTestFixture(t, "validate.db")
+
+	record_func := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+
+		if strings.HasSuffix(path, "_test.go") {
+			return []byte(invalid_feature), nil
+		}
+
+		return []byte(valid_feature), nil
+	}
+
+	build := func(policy string) (*SQLiteIndexer, error) {
+
+		idx := f.indexer(t, &SQLiteIndexerOptions{
+			LoadRecordFunc:   record_func,
+			Validators:       WOFValidators(),
+			ValidationPolicy: policy,
+		})
+
+		return idx, idx.IndexURIs(f.ctx, "directory://", f.path("config"))
+	}
+
+	_, err := build("")
+
+	var v_err *ValidationError
+
+	if !errors.As(err, &v_err) {
+		t.Fatalf("Expected invalid record to stop the run, got %v", err)
+	}
+
+	idx, err := build(TABLE_POLICY_BEST_EFFORT)
+
+	if err != nil {
+		t.Fatalf("Expected invalid records to be skipped, %v", err)
+	}
+
+	stats := idx.Stats()
+
+	if stats.Invalid != 1 || stats.Skipped != 1 || stats.Indexed != 1 {
+		t.Fatalf("Unexpected stats %v", stats)
+	}
+
+	_, err = NewSQLiteIndexer(&SQLiteIndexerOptions{
+		ValidationPolicy: TABLE_POLICY_DISABLE_AFTER,
+	})
+
+	if err == nil {
+		t.Fatalf("Expected disable-after validation policy to fail")
+	}
+}